@@ -0,0 +1,115 @@
+package channels
+
+import (
+	"sync"
+	"time"
+
+	"github.com/unklearn/notebook-backend/commands"
+)
+
+// Number of output batches kept per command by default
+const DefaultOutputHistorySize = 256
+
+// OutputHistory is a bounded ring buffer of the output sent for a command. Every output
+// message is numbered, starting at 1, so that a client that lost its connection can
+// ask for the output it missed
+type OutputHistory struct {
+	mu      sync.Mutex
+	entries []commands.CommandOutputEntry
+	// Index of the oldest entry and number of entries held
+	start int
+	count int
+	// Sequence number of the last appended entry
+	lastSeq uint64
+}
+
+func NewOutputHistory(size int) *OutputHistory {
+	return &OutputHistory{entries: make([]commands.CommandOutputEntry, size)}
+}
+
+// Append an output message to the history, evicting the oldest message if the history
+// is full. Returns the sequence number of the message
+func (oh *OutputHistory) Append(eventName string, data []byte) uint64 {
+	oh.mu.Lock()
+	defer oh.mu.Unlock()
+	oh.lastSeq += 1
+	if len(oh.entries) == 0 {
+		return oh.lastSeq
+	}
+	entry := commands.CommandOutputEntry{Seq: oh.lastSeq, EventName: eventName, Data: data}
+	if oh.count < len(oh.entries) {
+		oh.entries[(oh.start+oh.count)%len(oh.entries)] = entry
+		oh.count += 1
+	} else {
+		oh.entries[oh.start] = entry
+		oh.start = (oh.start + 1) % len(oh.entries)
+	}
+	return oh.lastSeq
+}
+
+// Return the messages with a sequence number greater than seq. complete is false if
+// some of those messages have already been evicted
+func (oh *OutputHistory) Since(seq uint64) (entries []commands.CommandOutputEntry, complete bool) {
+	oh.mu.Lock()
+	defer oh.mu.Unlock()
+	entries = []commands.CommandOutputEntry{}
+	oldest := oh.lastSeq - uint64(oh.count) + 1
+	for i := 0; i < oh.count; i++ {
+		entry := oh.entries[(oh.start+i)%len(oh.entries)]
+		if entry.Seq > seq {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, seq+1 >= oldest
+}
+
+// A finished command, along with the output history it left behind
+type finishedOutputHistory struct {
+	cellId     string
+	history    *OutputHistory
+	finishedAt time.Time
+}
+
+// FinishedOutputHistories keeps the output history of finished commands for a retention
+// window, so that a notebook that missed the end of a command can still replay it
+type FinishedOutputHistories struct {
+	mu        sync.Mutex
+	retention time.Duration
+	// Histories keyed by exec id
+	histories map[string]finishedOutputHistory
+}
+
+func NewFinishedOutputHistories(retention time.Duration) *FinishedOutputHistories {
+	return &FinishedOutputHistories{retention: retention, histories: make(map[string]finishedOutputHistory)}
+}
+
+// Keep the history of a command that finished at the given time
+func (fh *FinishedOutputHistories) Add(execId string, cellId string, history *OutputHistory, now time.Time) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	fh.expire(now)
+	if fh.retention > 0 {
+		fh.histories[execId] = finishedOutputHistory{cellId: cellId, history: history, finishedAt: now}
+	}
+}
+
+// Return the history of a finished command of a cell, if it is still retained
+func (fh *FinishedOutputHistories) Get(execId string, cellId string, now time.Time) (*OutputHistory, bool) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	fh.expire(now)
+	h, ok := fh.histories[execId]
+	if !ok || h.cellId != cellId {
+		return nil, false
+	}
+	return h.history, true
+}
+
+// Drop histories that have been kept for longer than the retention window
+func (fh *FinishedOutputHistories) expire(now time.Time) {
+	for execId, h := range fh.histories {
+		if now.Sub(h.finishedAt) >= fh.retention {
+			delete(fh.histories, execId)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package channels
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unklearn/notebook-backend/commands"
+)
+
+func TestOutputHistorySince(t *testing.T) {
+	oh := NewOutputHistory(4)
+	assert.Equal(t, oh.Append("command/stdout", []byte("a")), uint64(1))
+	assert.Equal(t, oh.Append("command/stderr", []byte("b")), uint64(2))
+	entries, complete := oh.Since(1)
+	assert.Equal(t, complete, true)
+	assert.Equal(t, entries, []commands.CommandOutputEntry{{Seq: 2, EventName: "command/stderr", Data: []byte("b")}})
+	entries, complete = oh.Since(0)
+	assert.Equal(t, complete, true)
+	assert.Equal(t, len(entries), 2)
+	entries, complete = oh.Since(2)
+	assert.Equal(t, complete, true)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestOutputHistoryEviction(t *testing.T) {
+	oh := NewOutputHistory(2)
+	oh.Append("command/output", []byte("a"))
+	oh.Append("command/output", []byte("b"))
+	oh.Append("command/output", []byte("c"))
+	// Message 1 has been evicted
+	entries, complete := oh.Since(0)
+	assert.Equal(t, complete, false)
+	assert.Equal(t, len(entries), 2)
+	assert.Equal(t, entries[0].Data, []byte("b"))
+	assert.Equal(t, entries[1].Data, []byte("c"))
+	entries, complete = oh.Since(1)
+	assert.Equal(t, complete, true)
+	assert.Equal(t, len(entries), 2)
+}
+
+func TestFinishedOutputHistories(t *testing.T) {
+	fh := NewFinishedOutputHistories(time.Minute)
+	oh := NewOutputHistory(4)
+	now := time.Now()
+	fh.Add("exec", "cell", oh, now)
+	got, ok := fh.Get("exec", "cell", now.Add(time.Second))
+	assert.Equal(t, ok, true)
+	assert.Equal(t, got, oh)
+	// The exec must belong to the cell
+	_, ok = fh.Get("exec", "other", now.Add(time.Second))
+	assert.Equal(t, ok, false)
+	// Histories are dropped after the retention window
+	_, ok = fh.Get("exec", "cell", now.Add(time.Minute))
+	assert.Equal(t, ok, false)
+
+	// A retention of 0 keeps nothing
+	fh = NewFinishedOutputHistories(0)
+	fh.Add("exec", "cell", oh, now)
+	_, ok = fh.Get("exec", "cell", now)
+	assert.Equal(t, ok, false)
+}
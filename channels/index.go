@@ -2,10 +2,16 @@ package channels
 
 import (
 	"fmt"
+	"io"
+	"sync"
 
 	"github.com/unklearn/notebook-backend/commands"
 )
 
+// Event on which errors are reported to the notebook, on the channel they happened on.
+// The payload is a commands.ErrorResponse
+const ErrorEventName = "error"
+
 type IChannel interface {
 	HandleMessage(eventName string, payload []byte) ([]commands.ActionIntent, error)
 	GetId() string
@@ -27,9 +33,10 @@ func NewRootChannel(id string) *RootChannel {
 type RootChannelEventNames string
 
 const (
-	ContainerStartEventName  RootChannelEventNames = "root/container-start"
-	ContainerStopEventName   RootChannelEventNames = "root/container-stop"
-	ContainerStatusEventName RootChannelEventNames = "root/container-status"
+	ContainerStartEventName    RootChannelEventNames = "root/container-start"
+	ContainerStopEventName     RootChannelEventNames = "root/container-stop"
+	ContainerStatusEventName   RootChannelEventNames = "root/container-status"
+	ImagePullProgressEventName RootChannelEventNames = "root/image-pull-progress"
 )
 
 // Return id for external callers
@@ -48,10 +55,17 @@ func (rc RootChannel) HandleMessage(eventName string, payload []byte) ([]command
 			return []commands.ActionIntent{}, e
 		}
 		return []commands.ActionIntent{c}, nil
+	case string(ContainerStopEventName):
+		// Parse body into StopContainer
+		c, e := commands.NewContainerStopCommandIntent(rc.id, payload)
+		if e != nil {
+			return []commands.ActionIntent{}, e
+		}
+		return []commands.ActionIntent{c}, nil
 	default:
 		break
 	}
-	return []commands.ActionIntent{}, fmt.Errorf("unknown event name %s", eventName)
+	return []commands.ActionIntent{}, commands.NewErrorResponse("unknown-event", fmt.Sprintf("unknown event name %s", eventName))
 }
 
 // A container channel wraps a single container
@@ -98,10 +112,17 @@ func (cc ContainerChannel) HandleMessage(eventName string, payload []byte) ([]co
 			return []commands.ActionIntent{}, e
 		}
 		return []commands.ActionIntent{c}, nil
+	case string(ContainerCommandReplayEventName):
+		// The channel of a finished command is gone, its output is replayed through the container
+		c, e := commands.NewFinishedCommandReplayIntent(cc.id, payload)
+		if e != nil {
+			return []commands.ActionIntent{}, e
+		}
+		return []commands.ActionIntent{c}, nil
 	default:
 		break
 	}
-	return []commands.ActionIntent{}, fmt.Errorf("unknown event name %s", eventName)
+	return []commands.ActionIntent{}, commands.NewErrorResponse("unknown-event", fmt.Sprintf("unknown event name %s", eventName))
 }
 
 // A container conduit acts as a bidirectional communication channel between
@@ -109,30 +130,159 @@ func (cc ContainerChannel) HandleMessage(eventName string, payload []byte) ([]co
 type BidirectionalContainerConduit struct {
 	// Used to refer to the running command, if required
 	ExecId string
-	// Used for stdout and stderr streams
+	// Used for stdout, or the combined output of commands that run with a TTY
 	ReadChan chan []byte
+	// Used for stderr. A TTY merges stderr into stdout, so it is closed right away
+	// for commands that run with a TTY
+	ErrChan chan []byte
 	// Used for stdin
 	WriteChan chan []byte
-	// Used for communicating error codes etc
-	CommChan chan string
+	// Output sent for the command, kept so that it can be replayed
+	History *OutputHistory
+	// Tears down the underlying connection to the command
+	closer    io.Closer
+	closeOnce sync.Once
+	// Closed when the conduit is closed, so that goroutines serving the conduit can exit
+	done chan struct{}
+	// First error that broke the output streams, if any
+	errMu sync.Mutex
+	err   error
+	// Set while the container of the command is being stopped
+	stopped bool
+	// Id of the connection that owns stdin, only one viewer of a command can write to it
+	ownerMu    sync.Mutex
+	stdinOwner string
+}
+
+// Constructor function for a conduit. The closer is invoked once, when the conduit
+// is closed
+func NewBidirectionalContainerConduit(execId string, closer io.Closer) *BidirectionalContainerConduit {
+	return &BidirectionalContainerConduit{
+		ExecId:    execId,
+		ReadChan:  make(chan []byte),
+		ErrChan:   make(chan []byte),
+		WriteChan: make(chan []byte),
+		History:   NewOutputHistory(DefaultOutputHistorySize),
+		closer:    closer,
+		done:      make(chan struct{}),
+	}
+}
+
+// Return a channel that is closed once the conduit has been closed
+func (bcc *BidirectionalContainerConduit) Done() <-chan struct{} {
+	return bcc.done
+}
+
+// Write data onto the stdin of the command. Returns an error if the conduit has been closed
+func (bcc *BidirectionalContainerConduit) Write(data []byte) error {
+	select {
+	case <-bcc.done:
+		return commands.NewErrorResponse("command-exited", fmt.Sprintf("command %s has exited", bcc.ExecId))
+	default:
+	}
+	select {
+	case bcc.WriteChan <- data:
+		return nil
+	case <-bcc.done:
+		return commands.NewErrorResponse("command-exited", fmt.Sprintf("command %s has exited", bcc.ExecId))
+	}
+}
+
+// Claim stdin of the command for a connection. Stdin that is not owned goes to the first
+// connection that claims it. Returns true if the connection owns stdin
+func (bcc *BidirectionalContainerConduit) ClaimStdin(connectionId string) bool {
+	bcc.ownerMu.Lock()
+	defer bcc.ownerMu.Unlock()
+	if bcc.stdinOwner == "" {
+		bcc.stdinOwner = connectionId
+	}
+	return bcc.stdinOwner == connectionId
+}
+
+// Release stdin of the command if it is owned by the connection, e.g. when it disconnects
+func (bcc *BidirectionalContainerConduit) ReleaseStdin(connectionId string) {
+	bcc.ownerMu.Lock()
+	defer bcc.ownerMu.Unlock()
+	if bcc.stdinOwner == connectionId {
+		bcc.stdinOwner = ""
+	}
+}
+
+// Record an error that broke the output streams of the command. Only the first error is kept
+func (bcc *BidirectionalContainerConduit) SetErr(err error) {
+	bcc.errMu.Lock()
+	defer bcc.errMu.Unlock()
+	if bcc.err == nil {
+		bcc.err = err
+	}
+}
+
+// Return the error that broke the output streams of the command, if any
+func (bcc *BidirectionalContainerConduit) Err() error {
+	bcc.errMu.Lock()
+	defer bcc.errMu.Unlock()
+	return bcc.err
+}
+
+// Mark the command as stopped along with its container, so that its output ending
+// is not mistaken for a failure
+func (bcc *BidirectionalContainerConduit) SetStopped(stopped bool) {
+	bcc.errMu.Lock()
+	defer bcc.errMu.Unlock()
+	bcc.stopped = stopped
+}
+
+// Returns true if the container of the command is being stopped
+func (bcc *BidirectionalContainerConduit) Stopped() bool {
+	bcc.errMu.Lock()
+	defer bcc.errMu.Unlock()
+	return bcc.stopped
+}
+
+// Close the underlying connection to the command and signal goroutines serving the
+// conduit to exit. The output channels are closed by their readers on exit. Calling
+// Close more than once is a no-op
+func (bcc *BidirectionalContainerConduit) Close() error {
+	var err error
+	bcc.closeOnce.Do(func() {
+		close(bcc.done)
+		if bcc.closer != nil {
+			err = bcc.closer.Close()
+		}
+	})
+	return err
 }
 
 type ContainerCommandChannelEventNames string
 
 const (
+	// Combined output of commands that run with a TTY
 	ContainerCommandOutputEventName ContainerCommandChannelEventNames = "command/output"
-	ContainerCommandInputEventname  ContainerCommandChannelEventNames = "command/input"
+	// Demultiplexed stdout and stderr of commands that run without a TTY
+	ContainerCommandStdoutEventName ContainerCommandChannelEventNames = "command/stdout"
+	ContainerCommandStderrEventName ContainerCommandChannelEventNames = "command/stderr"
+	// Sent when output is dropped to stay under the max throughput of the command
+	ContainerCommandOutputTruncatedEventName ContainerCommandChannelEventNames = "command/output-truncated"
+	ContainerCommandInputEventname           ContainerCommandChannelEventNames = "command/input"
+	ContainerCommandSignalEventName          ContainerCommandChannelEventNames = "command/signal"
+	ContainerCommandResizeEventName          ContainerCommandChannelEventNames = "command/resize"
+	// Requests and returns the output sent after a sequence number. Output messages
+	// of a command are numbered in the order they are sent, starting at 1. Once the
+	// command has finished, its output is replayed through the container channel
+	ContainerCommandReplayEventName ContainerCommandChannelEventNames = "command/replay"
 )
 
 type ContainerCommandChannel struct {
-	id          string
+	id string
+	// id of the container that runs the command
+	containerId string
 	conduit     *BidirectionalContainerConduit
 	emptyIntent []commands.ActionIntent
 }
 
 // Constructor function for new command channel
-func NewContainerCommandChannel(id string, conduit *BidirectionalContainerConduit) *ContainerCommandChannel {
-	return &ContainerCommandChannel{id: id, conduit: conduit, emptyIntent: []commands.ActionIntent{}}
+func NewContainerCommandChannel(id string, containerId string, conduit *BidirectionalContainerConduit) *ContainerCommandChannel {
+	return &ContainerCommandChannel{id: id, containerId: containerId, conduit: conduit, emptyIntent: []commands.ActionIntent{}}
 }
 
 // Return id for external callers
@@ -140,6 +290,46 @@ func (cce ContainerCommandChannel) GetId() string {
 	return cce.id
 }
 
+// Return the id of the container the command runs in
+func (cce ContainerCommandChannel) GetContainerId() string {
+	return cce.containerId
+}
+
+// Command channels are nested under the channel of their container
+func (cce ContainerCommandChannel) GetParentId() string {
+	return cce.containerId
+}
+
+// Return the id of the exec that runs the command
+func (cce ContainerCommandChannel) GetExecId() string {
+	return cce.conduit.ExecId
+}
+
+// Return the output history of the command
+func (cce ContainerCommandChannel) GetHistory() *OutputHistory {
+	return cce.conduit.History
+}
+
+// Claim stdin of the command for a connection, see BidirectionalContainerConduit.ClaimStdin
+func (cce ContainerCommandChannel) ClaimStdin(connectionId string) bool {
+	return cce.conduit.ClaimStdin(connectionId)
+}
+
+// Release stdin of the command if it is owned by the connection
+func (cce ContainerCommandChannel) ReleaseStdin(connectionId string) {
+	cce.conduit.ReleaseStdin(connectionId)
+}
+
+// Mark the command as stopped along with its container
+func (cce ContainerCommandChannel) SetStopped(stopped bool) {
+	cce.conduit.SetStopped(stopped)
+}
+
+// Close the conduit to the command
+func (cce ContainerCommandChannel) Close() error {
+	return cce.conduit.Close()
+}
+
 // HandleMessage takes care of a given event and payload. If payload cannot be handled, error
 // is returned
 func (cce ContainerCommandChannel) HandleMessage(eventName string, payload []byte) ([]commands.ActionIntent, error) {
@@ -152,10 +342,27 @@ func (cce ContainerCommandChannel) HandleMessage(eventName string, payload []byt
 		}
 		return []commands.ActionIntent{c}, nil
 	case string(ContainerCommandInputEventname):
-		cce.conduit.WriteChan <- payload
-		return cce.emptyIntent, nil
+		return cce.emptyIntent, cce.conduit.Write(payload)
+	case string(ContainerCommandSignalEventName):
+		c, e := commands.NewContainerCommandSignalIntent(cce.containerId, cce.id, cce.conduit.ExecId, payload)
+		if e != nil {
+			return cce.emptyIntent, e
+		}
+		return []commands.ActionIntent{c}, nil
+	case string(ContainerCommandReplayEventName):
+		c, e := commands.NewContainerCommandReplayIntent(cce.containerId, cce.id, cce.conduit.ExecId, payload)
+		if e != nil {
+			return cce.emptyIntent, e
+		}
+		return []commands.ActionIntent{c}, nil
+	case string(ContainerCommandResizeEventName):
+		c, e := commands.NewContainerCommandResizeIntent(cce.containerId, cce.id, cce.conduit.ExecId, payload)
+		if e != nil {
+			return cce.emptyIntent, e
+		}
+		return []commands.ActionIntent{c}, nil
 	default:
 		break
 	}
-	return cce.emptyIntent, fmt.Errorf("unknown event name %s", eventName)
+	return cce.emptyIntent, commands.NewErrorResponse("unknown-event", fmt.Sprintf("unknown event name %s", eventName))
 }
@@ -20,6 +20,16 @@ func TestHandleMessageContainerStart(t *testing.T) {
 	assert.IsType(t, &commands.ContainerCreateCommandIntent{}, its[0])
 }
 
+func TestHandleMessageContainerStop(t *testing.T) {
+	rc := NewRootChannel("chan")
+	its, err := rc.HandleMessage(string(ContainerStopEventName), []byte(`{"container_id": "foo"}`))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(its), 1)
+	assert.IsType(t, commands.ContainerStopCommandIntent{}, its[0])
+	_, err = rc.HandleMessage(string(ContainerStopEventName), []byte(`{}`))
+	assert.NotEqual(t, err, nil)
+}
+
 func TestHandleMessageUnknownType(t *testing.T) {
 	rc := NewRootChannel("chan")
 	_, err := rc.HandleMessage("many", []byte(`{"container_id": "foo"}`))
@@ -34,3 +44,84 @@ func TestContainerChannelExecuteCommand(t *testing.T) {
 	c, _ := commands.NewContainerExecuteCommandIntent("foo", payload)
 	assert.Equal(t, intents[0], c)
 }
+
+type countingCloser struct {
+	closed int
+}
+
+func (c *countingCloser) Close() error {
+	c.closed += 1
+	return nil
+}
+
+func TestConduitClose(t *testing.T) {
+	closer := &countingCloser{}
+	conduit := NewBidirectionalContainerConduit("exec", closer)
+	assert.Equal(t, conduit.ExecId, "exec")
+	conduit.Close()
+	conduit.Close()
+	assert.Equal(t, closer.closed, 1)
+	_, open := <-conduit.Done()
+	assert.Equal(t, open, false)
+}
+
+func TestConduitStdinOwner(t *testing.T) {
+	conduit := NewBidirectionalContainerConduit("exec", nil)
+	cce := NewContainerCommandChannel("cell", "foo", conduit)
+	assert.Equal(t, cce.ClaimStdin("a"), true)
+	assert.Equal(t, cce.ClaimStdin("a"), true)
+	assert.Equal(t, cce.ClaimStdin("b"), false)
+	// Only the owner can release stdin
+	cce.ReleaseStdin("b")
+	assert.Equal(t, cce.ClaimStdin("b"), false)
+	cce.ReleaseStdin("a")
+	assert.Equal(t, cce.ClaimStdin("b"), true)
+	assert.Equal(t, cce.ClaimStdin("a"), false)
+}
+
+func TestContainerCommandChannelInput(t *testing.T) {
+	conduit := NewBidirectionalContainerConduit("exec", nil)
+	cce := NewContainerCommandChannel("cell", "foo", conduit)
+	go func() {
+		assert.Equal(t, <-conduit.WriteChan, []byte("ls\n"))
+	}()
+	_, e := cce.HandleMessage(string(ContainerCommandInputEventname), []byte("ls\n"))
+	assert.Equal(t, e, nil)
+	// Input for a closed command is rejected instead of blocking
+	cce.Close()
+	_, e = cce.HandleMessage(string(ContainerCommandInputEventname), []byte("ls\n"))
+	assert.NotEqual(t, e, nil)
+}
+
+func TestContainerCommandChannelSignal(t *testing.T) {
+	cce := NewContainerCommandChannel("cell", "foo", NewBidirectionalContainerConduit("exec", nil))
+	intents, e := cce.HandleMessage(string(ContainerCommandSignalEventName), []byte(`{"signal": "SIGINT"}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, intents[0], commands.ContainerCommandSignalIntent{ContainerId: "foo", CellId: "cell", ExecId: "exec", Signal: "SIGINT"})
+	_, e = cce.HandleMessage(string(ContainerCommandSignalEventName), []byte(`{"signal": "SIGSTOP"}`))
+	assert.NotEqual(t, e, nil)
+}
+
+func TestContainerCommandChannelResize(t *testing.T) {
+	cce := NewContainerCommandChannel("cell", "foo", NewBidirectionalContainerConduit("exec", nil))
+	intents, e := cce.HandleMessage(string(ContainerCommandResizeEventName), []byte(`{"rows": 24, "cols": 80}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, intents[0], commands.ContainerCommandResizeIntent{ContainerId: "foo", CellId: "cell", ExecId: "exec", Rows: 24, Cols: 80})
+}
+
+func TestContainerCommandChannelReplay(t *testing.T) {
+	cce := NewContainerCommandChannel("cell", "foo", NewBidirectionalContainerConduit("exec", nil))
+	intents, e := cce.HandleMessage(string(ContainerCommandReplayEventName), []byte(`{"since": 3}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, intents[0], commands.ContainerCommandReplayIntent{ContainerId: "foo", CellId: "cell", ExecId: "exec", Since: 3})
+	assert.NotEqual(t, cce.GetHistory(), nil)
+}
+
+func TestContainerChannelReplay(t *testing.T) {
+	cc := NewContainerChannel("foo")
+	intents, e := cc.HandleMessage(string(ContainerCommandReplayEventName), []byte(`{"cell_id": "cell", "exec_id": "exec", "since": 3}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, intents[0], commands.ContainerCommandReplayIntent{ContainerId: "foo", CellId: "cell", ExecId: "exec", Since: 3})
+	_, e = cc.HandleMessage(string(ContainerCommandReplayEventName), []byte(`{"since": 3}`))
+	assert.NotEqual(t, e, nil)
+}
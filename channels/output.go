@@ -0,0 +1,91 @@
+package channels
+
+import "time"
+
+// Options that control how command output is relayed to the notebook
+type OutputOptions struct {
+	// Output is batched for at most FlushInterval before being sent
+	FlushInterval time.Duration
+	// A batch is sent as soon as it holds FlushSize bytes
+	FlushSize int
+	// Maximum bytes per second relayed for a single command, shared by its stdout
+	// and stderr. Output over the limit is dropped, 0 disables the limit
+	MaxThroughput int
+}
+
+var DefaultOutputOptions = OutputOptions{
+	FlushInterval: 50 * time.Millisecond,
+	FlushSize:     16 * 1024,
+	MaxThroughput: 1024 * 1024,
+}
+
+// ThroughputLimiter enforces the max throughput of a command. The streams of a command
+// share a limiter, so that the command as a whole stays under the limit
+type ThroughputLimiter struct {
+	maxThroughput int
+	// Bytes accepted in the current one second window
+	windowStart time.Time
+	windowBytes int
+}
+
+func NewThroughputLimiter(maxThroughput int) *ThroughputLimiter {
+	return &ThroughputLimiter{maxThroughput: maxThroughput}
+}
+
+// Accept up to n bytes of output read at the given time. Returns the number of bytes
+// that fit in the budget of the current window
+func (tl *ThroughputLimiter) Accept(n int, now time.Time) int {
+	if tl.maxThroughput <= 0 {
+		return n
+	}
+	if now.Sub(tl.windowStart) >= time.Second {
+		tl.windowStart = now
+		tl.windowBytes = 0
+	}
+	allowed := tl.maxThroughput - tl.windowBytes
+	if allowed < 0 {
+		allowed = 0
+	}
+	if n > allowed {
+		n = allowed
+	}
+	tl.windowBytes += n
+	return n
+}
+
+// OutputCoalescer batches the output of a single command stream and enforces the max
+// throughput, so that chatty commands do not flood the notebook
+type OutputCoalescer struct {
+	options OutputOptions
+	limiter *ThroughputLimiter
+	batch   []byte
+	// Bytes dropped since the last batch was taken
+	dropped int
+}
+
+// Create a coalescer with a throughput limit of its own
+func NewOutputCoalescer(options OutputOptions) *OutputCoalescer {
+	return NewOutputCoalescerWithLimiter(options, NewThroughputLimiter(options.MaxThroughput))
+}
+
+// Create a coalescer that shares the throughput limit with other streams of the command
+func NewOutputCoalescerWithLimiter(options OutputOptions, limiter *ThroughputLimiter) *OutputCoalescer {
+	return &OutputCoalescer{options: options, limiter: limiter}
+}
+
+// Add output read at the given time to the batch. Returns true if the batch is full
+// and should be flushed right away
+func (oc *OutputCoalescer) Add(data []byte, now time.Time) bool {
+	allowed := oc.limiter.Accept(len(data), now)
+	oc.dropped += len(data) - allowed
+	oc.batch = append(oc.batch, data[:allowed]...)
+	return len(oc.batch) >= oc.options.FlushSize
+}
+
+// Take the batched output along with the number of bytes dropped since the last take
+func (oc *OutputCoalescer) Take() ([]byte, int) {
+	batch, dropped := oc.batch, oc.dropped
+	oc.batch = nil
+	oc.dropped = 0
+	return batch, dropped
+}
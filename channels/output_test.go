@@ -0,0 +1,53 @@
+package channels
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputCoalescerBatches(t *testing.T) {
+	oc := NewOutputCoalescer(OutputOptions{FlushSize: 6})
+	now := time.Now()
+	assert.Equal(t, oc.Add([]byte("foo"), now), false)
+	assert.Equal(t, oc.Add([]byte("bar"), now), true)
+	batch, dropped := oc.Take()
+	assert.Equal(t, batch, []byte("foobar"))
+	assert.Equal(t, dropped, 0)
+	batch, _ = oc.Take()
+	assert.Equal(t, len(batch), 0)
+}
+
+func TestOutputCoalescerMaxThroughput(t *testing.T) {
+	oc := NewOutputCoalescer(OutputOptions{FlushSize: 1024, MaxThroughput: 4})
+	now := time.Now()
+	oc.Add([]byte("foo"), now)
+	oc.Add([]byte("bar"), now.Add(time.Millisecond*500))
+	batch, dropped := oc.Take()
+	assert.Equal(t, batch, []byte("foob"))
+	assert.Equal(t, dropped, 2)
+
+	// Budget is restored in the next window
+	oc.Add([]byte("baz"), now.Add(time.Second))
+	batch, dropped = oc.Take()
+	assert.Equal(t, batch, []byte("baz"))
+	assert.Equal(t, dropped, 0)
+}
+
+func TestOutputCoalescerSharedLimiter(t *testing.T) {
+	options := OutputOptions{FlushSize: 1024, MaxThroughput: 4}
+	limiter := NewThroughputLimiter(options.MaxThroughput)
+	stdout := NewOutputCoalescerWithLimiter(options, limiter)
+	stderr := NewOutputCoalescerWithLimiter(options, limiter)
+	now := time.Now()
+	stdout.Add([]byte("foo"), now)
+	stderr.Add([]byte("bar"), now)
+	// Both streams draw from the same budget
+	batch, dropped := stdout.Take()
+	assert.Equal(t, batch, []byte("foo"))
+	assert.Equal(t, dropped, 0)
+	batch, dropped = stderr.Take()
+	assert.Equal(t, batch, []byte("b"))
+	assert.Equal(t, dropped, 2)
+}
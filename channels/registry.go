@@ -1,12 +1,25 @@
 package channels
 
 import (
-	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/unklearn/notebook-backend/commands"
 )
 
+// Channels that are nested under another channel, e.g. command channels are nested
+// under the channel of the container they run in
+type IParentedChannel interface {
+	GetParentId() string
+}
+
+// Registry maps channelIds to channels. It is safe for concurrent use, the zero value
+// is an empty registry ready to use
 type Registry struct {
+	mu sync.RWMutex
 	// Internal store for mapping channelId to channel
 	channelMap map[string]IChannel
 }
@@ -14,6 +27,8 @@ type Registry struct {
 // RegisterChannel registers a channel against a channelId.
 // If a channel exists for given channelId, it returns an error
 func (cr *Registry) RegisterChannel(channelId string, channel IChannel) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
 	log.Printf("Registering new channel %s\n", channelId)
 	if cr.channelMap == nil {
 		cr.channelMap = make(map[string]IChannel)
@@ -21,17 +36,37 @@ func (cr *Registry) RegisterChannel(channelId string, channel IChannel) error {
 	_, ok := cr.channelMap[channelId]
 	// If another channel exists, return error
 	if ok {
-		return fmt.Errorf("ECODE::dup-channel::There exists another channel for channelId %s", channelId)
+		return commands.NewErrorResponse("dup-channel", fmt.Sprintf("There exists another channel for channelId %s", channelId))
 	}
 	cr.channelMap[channelId] = channel
 	return nil
 }
 
+// ReplaceChannel registers a channel against a channelId, replacing any channel that
+// was registered for it. Returns the replaced channel, or nil if there was none
+func (cr *Registry) ReplaceChannel(channelId string, channel IChannel) IChannel {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.channelMap == nil {
+		cr.channelMap = make(map[string]IChannel)
+	}
+	previous := cr.channelMap[channelId]
+	if previous != nil {
+		log.Printf("Replacing channel %s\n", channelId)
+	} else {
+		log.Printf("Registering new channel %s\n", channelId)
+	}
+	cr.channelMap[channelId] = channel
+	return previous
+}
+
 // Deregister channel removes a channel from the store if it exists,
 // otherwise returns error
 func (cr *Registry) DeregisterChannel(channelId string) (IChannel, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
 	if cr.channelMap == nil {
-		return nil, errors.New("ECODE::missing-map::Registry has not been initialized")
+		return nil, commands.NewErrorResponse("missing-map", "Registry has not been initialized")
 	}
 	ch, ok := cr.channelMap[channelId]
 	if ok {
@@ -39,17 +74,59 @@ func (cr *Registry) DeregisterChannel(channelId string) (IChannel, error) {
 		delete(cr.channelMap, channelId)
 		return ch, nil
 	}
-	return nil, fmt.Errorf("ECODE::missing-channel::There exists no channel with channelId %s", channelId)
+	return nil, commands.NewErrorResponse("missing-channel", fmt.Sprintf("There exists no channel with channelId %s", channelId))
 }
 
 // Return a channel by id if it exists, otherwise return error
 func (cr *Registry) GetChannelById(channelId string) (IChannel, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
 	if cr.channelMap == nil {
-		return nil, errors.New("ECODE::missing-map::Registry has not been initialized")
+		return nil, commands.NewErrorResponse("missing-map", "Registry has not been initialized")
 	}
 	ch, ok := cr.channelMap[channelId]
 	if ok {
 		return ch, nil
 	}
-	return nil, fmt.Errorf("ECODE::missing-channel::There exists no channel with channelId %s", channelId)
+	return nil, commands.NewErrorResponse("missing-channel", fmt.Sprintf("There exists no channel with channelId %s", channelId))
+}
+
+// Return the registered channels that match, ordered by channelId
+func (cr *Registry) filterChannels(match func(channelId string, channel IChannel) bool) []IChannel {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	ids := make([]string, 0, len(cr.channelMap))
+	for id, ch := range cr.channelMap {
+		if match(id, ch) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	chs := make([]IChannel, 0, len(ids))
+	for _, id := range ids {
+		chs = append(chs, cr.channelMap[id])
+	}
+	return chs
+}
+
+// Return all registered channels, ordered by channelId
+func (cr *Registry) ListChannels() []IChannel {
+	return cr.filterChannels(func(string, IChannel) bool {
+		return true
+	})
+}
+
+// Return the channels whose channelId starts with prefix, ordered by channelId
+func (cr *Registry) ChannelsByPrefix(prefix string) []IChannel {
+	return cr.filterChannels(func(channelId string, _ IChannel) bool {
+		return strings.HasPrefix(channelId, prefix)
+	})
+}
+
+// Return the channels nested under the channel with parentId, ordered by channelId
+func (cr *Registry) ChannelsByParent(parentId string) []IChannel {
+	return cr.filterChannels(func(_ string, ch IChannel) bool {
+		pch, ok := ch.(IParentedChannel)
+		return ok && pch.GetParentId() == parentId
+	})
 }
@@ -1,7 +1,11 @@
 package channels
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 type dummyChannel struct {
@@ -74,3 +78,66 @@ func TestGetChannelById(t *testing.T) {
 		t.Error("Must return correct channel when id is passed correctly")
 	}
 }
+
+func TestListChannels(t *testing.T) {
+	cr := Registry{}
+	assert.Equal(t, len(cr.ListChannels()), 0)
+	foo := NewContainerChannel("foo")
+	bar := NewContainerChannel("bar")
+	cr.RegisterChannel("foo", foo)
+	cr.RegisterChannel("bar", bar)
+	assert.Equal(t, cr.ListChannels(), []IChannel{bar, foo})
+}
+
+func TestChannelsByPrefix(t *testing.T) {
+	cr := Registry{}
+	foo := NewContainerChannel("foo")
+	food := NewContainerChannel("food")
+	cr.RegisterChannel("foo", foo)
+	cr.RegisterChannel("food", food)
+	cr.RegisterChannel("bar", NewContainerChannel("bar"))
+	assert.Equal(t, cr.ChannelsByPrefix("foo"), []IChannel{foo, food})
+	assert.Equal(t, len(cr.ChannelsByPrefix("baz")), 0)
+}
+
+func TestChannelsByParent(t *testing.T) {
+	cr := Registry{}
+	cr.RegisterChannel("ctr", NewContainerChannel("ctr"))
+	first := NewContainerCommandChannel("cell-1", "ctr", NewBidirectionalContainerConduit("exec-1", nil))
+	second := NewContainerCommandChannel("cell-2", "ctr", NewBidirectionalContainerConduit("exec-2", nil))
+	cr.RegisterChannel("cell-1", first)
+	cr.RegisterChannel("cell-2", second)
+	cr.RegisterChannel("cell-3", NewContainerCommandChannel("cell-3", "other", NewBidirectionalContainerConduit("exec-3", nil)))
+	assert.Equal(t, cr.ChannelsByParent("ctr"), []IChannel{first, second})
+}
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	cr := Registry{}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("chan-%d", i)
+			cr.RegisterChannel(id, NewContainerChannel(id))
+			cr.GetChannelById(id)
+			cr.ReplaceChannel(id, NewContainerChannel(id))
+			cr.ListChannels()
+			cr.ChannelsByPrefix("chan-")
+			cr.ChannelsByParent("ctr")
+			cr.DeregisterChannel(id)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, len(cr.ListChannels()), 0)
+}
+
+func TestReplaceChannel(t *testing.T) {
+	cr := Registry{}
+	first := NewContainerChannel("first")
+	second := NewContainerChannel("second")
+	assert.Equal(t, cr.ReplaceChannel("dummy", first), nil)
+	assert.Equal(t, cr.ReplaceChannel("dummy", second), first)
+	ch, _ := cr.GetChannelById("dummy")
+	assert.Equal(t, ch, second)
+}
@@ -13,6 +13,26 @@ type ActionIntent interface {
 	// Parse message payload
 	GetIntentName() string
 	ToString() string
+	// Correlation id of the request the intent was parsed from
+	GetRequestId() string
+}
+
+// Envelope shared by the payloads of all requests. The request id is picked by the
+// notebook, and echoed on every response and error caused by the request
+type RequestEnvelope struct {
+	RequestId string `json:"request_id,omitempty"`
+}
+
+func (r RequestEnvelope) GetRequestId() string {
+	return r.RequestId
+}
+
+// Return the request id of a payload, or an empty id if the payload has none or cannot
+// be parsed. Used to correlate errors for payloads that are rejected
+func ParseRequestId(payload []byte) string {
+	r := RequestEnvelope{}
+	json.Unmarshal(payload, &r)
+	return r.RequestId
 }
 
 type ContainerNetworkOptions struct {
@@ -22,10 +42,12 @@ type ContainerNetworkOptions struct {
 // An intent that is designed to store container
 // creation configuration
 type ContainerCreateCommandIntent struct {
+	RequestEnvelope
 	// Id of the connection, can be notebookId or userId
 	ChannelId string `json:"-"`
 	// Optional, can be used to sync with existing container
-	// if the notebook sends in the command intent from front-end
+	// if the notebook sends in the command intent from front-end.
+	// A new container is created if the given container no longer exists
 	ContainerId string `json:"container_id"`
 	// The name of the container
 	Name string `json:"name"`
@@ -85,23 +107,95 @@ func NewContainerCreateCommandIntent(channelId string, payload []byte) (Containe
 	if len(errors) > 0 {
 		return i, fmt.Errorf(strings.Join(errors, "\n"))
 	}
+	// The hash predates request ids, it correlates requests that have no request id
+	if i.RequestId == "" {
+		i.RequestId = i.Hash
+	}
+	return i, nil
+}
+
+// An intent that stops a running container and removes it
+type ContainerStopCommandIntent struct {
+	RequestEnvelope
+	// Id of the connection, can be notebookId or userId
+	ChannelId string `json:"-"`
+	// Id of the container to stop
+	ContainerId string `json:"container_id"`
+	// Grace period in seconds before the container is killed, defaults to 10 and is at
+	// most MaxContainerStopTimeout
+	Timeout int `json:"timeout,omitempty"`
+	// Hash for tracking which request corresponds to failure
+	Hash string `json:"hash"`
+}
+
+func (i ContainerStopCommandIntent) GetIntentName() string {
+	return "ContainerStopCommandIntent"
+}
+
+func (i ContainerStopCommandIntent) ToString() string {
+	return fmt.Sprintf("%#v", i)
+}
+
+// Longest grace period a stop can ask for, in seconds
+const MaxContainerStopTimeout = 60
+
+// Factory method that supplies new stop intent or error, when supplied with JSON
+// representation of body
+func NewContainerStopCommandIntent(channelId string, payload []byte) (ContainerStopCommandIntent, error) {
+	i := ContainerStopCommandIntent{
+		ChannelId: channelId,
+	}
+	err := json.Unmarshal(payload, &i)
+	if err != nil {
+		log.Printf("Error while unmarshalling container stop input: %s", err.Error())
+		return i, fmt.Errorf("invalid input supplied for stopping container")
+	}
+	errors := []string{}
+	if i.ContainerId == "" {
+		errors = append(errors, "`container_id` is a required field")
+	}
+	if i.Timeout < 0 {
+		errors = append(errors, "`timeout` cannot be negative")
+	}
+	if i.Timeout > MaxContainerStopTimeout {
+		errors = append(errors, fmt.Sprintf("`timeout` cannot be greater than %d", MaxContainerStopTimeout))
+	}
+	if len(errors) > 0 {
+		return i, fmt.Errorf(strings.Join(errors, "\n"))
+	}
+	if i.Timeout == 0 {
+		i.Timeout = 10
+	}
+	if i.RequestId == "" {
+		i.RequestId = i.Hash
+	}
 	return i, nil
 }
 
 // Ensure that the provided image and tag exists on the system
 type ImagePullCommandIntent struct {
-	Image   string
-	Tag     string
-	RepoUrl string
+	RequestEnvelope
+	// Id of the channel that receives pull progress
+	ChannelId string
+	Image     string
+	Tag       string
+	RepoUrl   string
+	// Hash of the request that triggered the pull
+	Hash string
 }
 
 func (i ImagePullCommandIntent) GetIntentName() string {
 	return "ImagePullCommandIntent"
 }
 
+func (i ImagePullCommandIntent) ToString() string {
+	return fmt.Sprintf("%#v", i)
+}
+
 // Wait for a container to be started, sometimes images do not exist, and images
 // must be pulled
 type ContainerWaitCommandIntent struct {
+	RequestEnvelope
 	ContainerId string
 	// Timeout in seconds
 	Timeout int
@@ -117,6 +211,7 @@ func (i ContainerWaitCommandIntent) ToString() string {
 
 // An intent that can be used to execute a command inside container
 type ContainerExecuteCommandIntent struct {
+	RequestEnvelope
 	// Id of container
 	ContainerId string `json:"-"`
 	// The id of the cell to correlate command execution inside notebook.
@@ -127,10 +222,18 @@ type ContainerExecuteCommandIntent struct {
 	Interactive bool `json:"interactive,omitempty"`
 	// Whether command requires tty
 	UseTty bool `json:"use_tty,omitempty"`
-	// Used to timeout commands if necessary
+	// Timeout in seconds after which the command is killed, 0 lets the command run until it exits
 	Timeout int `json:"timeout,omitempty"`
+	// Whether a command that is still running for the cell keeps running when the
+	// cell is re-run. By default it is killed
+	KeepPrevious bool `json:"keep_previous,omitempty"`
+	// Initial size of the TTY, only used when use_tty is set
+	Rows uint `json:"rows,omitempty"`
+	Cols uint `json:"cols,omitempty"`
 	// The command to execute along with args
 	Command []string `json:"command"`
+	// Id of the connection that runs the command, it owns stdin of the command
+	ConnectionId string `json:"-"`
 }
 
 func (i ContainerExecuteCommandIntent) GetIntentName() string {
@@ -154,16 +257,155 @@ func NewContainerExecuteCommandIntent(containerId string, payload []byte) (Conta
 	return c, nil
 }
 
+// Signals that can be sent to a running command
+var allowedCommandSignals = map[string]bool{"SIGINT": true, "SIGTERM": true, "SIGKILL": true}
+
+// An intent that delivers a signal to a running command, e.g. to interrupt a hung cell
+type ContainerCommandSignalIntent struct {
+	RequestEnvelope
+	// Id of container
+	ContainerId string `json:"-"`
+	// Id of the cell that runs the command
+	CellId string `json:"-"`
+	// Id of the exec to signal
+	ExecId string `json:"-"`
+	// One of SIGINT, SIGTERM or SIGKILL
+	Signal string `json:"signal"`
+}
+
+func (i ContainerCommandSignalIntent) GetIntentName() string {
+	return "ContainerCommandSignalIntent"
+}
+
+func (i ContainerCommandSignalIntent) ToString() string {
+	return fmt.Sprintf("%#v", i)
+}
+
+// Constructor function for command signal intent
+func NewContainerCommandSignalIntent(containerId string, cellId string, execId string, payload []byte) (ContainerCommandSignalIntent, error) {
+	i := ContainerCommandSignalIntent{ContainerId: containerId, CellId: cellId, ExecId: execId}
+	err := json.Unmarshal(payload, &i)
+	if err != nil {
+		return i, err
+	}
+	i.Signal = strings.ToUpper(i.Signal)
+	if !strings.HasPrefix(i.Signal, "SIG") {
+		i.Signal = "SIG" + i.Signal
+	}
+	if !allowedCommandSignals[i.Signal] {
+		return i, fmt.Errorf("`signal` must be one of SIGINT, SIGTERM or SIGKILL")
+	}
+	return i, nil
+}
+
+// An intent that resizes the TTY of a running command
+type ContainerCommandResizeIntent struct {
+	RequestEnvelope
+	// Id of container
+	ContainerId string `json:"-"`
+	// Id of the cell that runs the command
+	CellId string `json:"-"`
+	// Id of the exec to resize
+	ExecId string `json:"-"`
+	Rows   uint   `json:"rows"`
+	Cols   uint   `json:"cols"`
+}
+
+func (i ContainerCommandResizeIntent) GetIntentName() string {
+	return "ContainerCommandResizeIntent"
+}
+
+func (i ContainerCommandResizeIntent) ToString() string {
+	return fmt.Sprintf("%#v", i)
+}
+
+// Constructor function for command resize intent
+func NewContainerCommandResizeIntent(containerId string, cellId string, execId string, payload []byte) (ContainerCommandResizeIntent, error) {
+	i := ContainerCommandResizeIntent{ContainerId: containerId, CellId: cellId, ExecId: execId}
+	err := json.Unmarshal(payload, &i)
+	if err != nil {
+		return i, err
+	}
+	errors := []string{}
+	if i.Rows == 0 {
+		errors = append(errors, "`rows` must be greater than 0")
+	}
+	if i.Cols == 0 {
+		errors = append(errors, "`cols` must be greater than 0")
+	}
+	if len(errors) > 0 {
+		return i, fmt.Errorf(strings.Join(errors, "\n"))
+	}
+	return i, nil
+}
+
+// An intent that requests the output a command sent after a given sequence number
+type ContainerCommandReplayIntent struct {
+	RequestEnvelope
+	// Id of container
+	ContainerId string `json:"-"`
+	// Id of the cell that runs the command
+	CellId string `json:"-"`
+	// Id of the exec to replay output for
+	ExecId string `json:"-"`
+	// Sequence number of the last output message received, 0 replays all held output
+	Since uint64 `json:"since"`
+}
+
+func (i ContainerCommandReplayIntent) GetIntentName() string {
+	return "ContainerCommandReplayIntent"
+}
+
+func (i ContainerCommandReplayIntent) ToString() string {
+	return fmt.Sprintf("%#v", i)
+}
+
+// Constructor function for command replay intent
+func NewContainerCommandReplayIntent(containerId string, cellId string, execId string, payload []byte) (ContainerCommandReplayIntent, error) {
+	i := ContainerCommandReplayIntent{ContainerId: containerId, CellId: cellId, ExecId: execId}
+	err := json.Unmarshal(payload, &i)
+	if err != nil {
+		return i, err
+	}
+	return i, nil
+}
+
+// Constructor function for replaying the output of a finished command. Its channel is
+// gone, so the cell and exec are named in the payload
+func NewFinishedCommandReplayIntent(containerId string, payload []byte) (ContainerCommandReplayIntent, error) {
+	p := struct {
+		CellId string `json:"cell_id"`
+		ExecId string `json:"exec_id"`
+	}{}
+	err := json.Unmarshal(payload, &p)
+	if err != nil {
+		return ContainerCommandReplayIntent{}, err
+	}
+	errors := []string{}
+	if p.CellId == "" {
+		errors = append(errors, "`cell_id` is a required field")
+	}
+	if p.ExecId == "" {
+		errors = append(errors, "`exec_id` is a required field")
+	}
+	if len(errors) > 0 {
+		return ContainerCommandReplayIntent{}, fmt.Errorf(strings.Join(errors, "\n"))
+	}
+	return NewContainerCommandReplayIntent(containerId, p.CellId, p.ExecId, payload)
+}
+
 // SyncFileIntent syncs the file from server onto the client
 type SyncFileIntent struct {
+	RequestEnvelope
 	// Id of the container
 	ContainerId string `json:"-"`
 	// Path to file including extension
 	FilePath string `json:"file_path"`
 	// Id of the cell
 	CellId string `json:"cell_id"`
-	// Optional content if notebook is writing in
-	Content string `json:"content,omitempty"`
+	// Content the notebook is writing in. The file is read if it is left out, and
+	// truncated if it is empty
+	Content *string `json:"content,omitempty"`
 }
 
 func (i SyncFileIntent) GetIntentName() string {
@@ -49,12 +49,19 @@ func TestContainerExecuteCommandIntent(t *testing.T) {
 	assert.Equal(t, i.Timeout, 123)
 	assert.Equal(t, i.Command, []string{"cat", ">", "oyo.py"})
 
+	// Try with initial tty size
+	i, e = NewContainerExecuteCommandIntent("foo", []byte(`{"cell_id": "bar", "use_tty": true, "rows": 24, "cols": 80, "command": ["vim"]}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, i.Rows, uint(24))
+	assert.Equal(t, i.Cols, uint(80))
+
 	// Try with missing values
 	i, e = NewContainerExecuteCommandIntent("foo", []byte(`{"command": ["bash"], "cell_id": "bar"}`))
 	assert.Equal(t, e, nil)
 	assert.Equal(t, i.ContainerId, "foo")
 	assert.Equal(t, i.Interactive, false)
 	assert.Equal(t, i.UseTty, false)
+	assert.Equal(t, i.KeepPrevious, false)
 	assert.Equal(t, i.Command, []string{"bash"})
 
 	// Try with wrong args
@@ -62,12 +69,38 @@ func TestContainerExecuteCommandIntent(t *testing.T) {
 	assert.Equal(t, e.Error(), "command cannot be empty")
 }
 
+func TestIntentRequestId(t *testing.T) {
+	i, e := NewContainerExecuteCommandIntent("foo", []byte(`{"request_id": "req-1", "cell_id": "bar", "command": ["ls"]}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, i.GetRequestId(), "req-1")
+	s, e := NewSyncFileIntent("foo", []byte(`{"request_id": "req-2", "cell_id": "bar", "file_path": "/app.py"}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, s.GetRequestId(), "req-2")
+
+	// The hash is used for requests that have no request id
+	c, e := NewContainerStopCommandIntent("chan", []byte(`{"container_id": "foo", "hash": "h"}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, c.GetRequestId(), "h")
+	c, _ = NewContainerStopCommandIntent("chan", []byte(`{"container_id": "foo", "hash": "h", "request_id": "req-3"}`))
+	assert.Equal(t, c.GetRequestId(), "req-3")
+
+	assert.Equal(t, ParseRequestId([]byte(`{"request_id": "req-4", "command": []}`)), "req-4")
+	assert.Equal(t, ParseRequestId([]byte(`not json`)), "")
+}
+
 func TestNewSyncFileIntent(t *testing.T) {
 	i, _ := NewSyncFileIntent("containerId", []byte(`{"cell_id": "cid", "file_path":"/var/app.py", "content":"foo"}`))
 	assert.Equal(t, i.ContainerId, "containerId")
 	assert.Equal(t, i.CellId, "cid")
 	assert.Equal(t, i.FilePath, "/var/app.py")
-	assert.Equal(t, i.Content, "foo")
+	assert.Equal(t, *i.Content, "foo")
+
+	// An empty file is written, not read
+	i, _ = NewSyncFileIntent("containerId", []byte(`{"cell_id": "cid", "file_path":"/var/app.py", "content":""}`))
+	assert.NotNil(t, i.Content)
+	assert.Equal(t, *i.Content, "")
+	i, _ = NewSyncFileIntent("containerId", []byte(`{"cell_id": "cid", "file_path":"/var/app.py"}`))
+	assert.Nil(t, i.Content)
 
 	// Try with error
 	_, e := NewSyncFileIntent("containerId", []byte(`{"cell_id": "cid"}`))
@@ -77,3 +110,83 @@ func TestNewSyncFileIntent(t *testing.T) {
 	assert.NotEqual(t, e, nil)
 	assert.Equal(t, e.Error(), "`cell_id` is a required field")
 }
+
+func TestContainerStopCommandIntent(t *testing.T) {
+	i, e := NewContainerStopCommandIntent("chan", []byte(`{"container_id": "foo", "hash": "abc"}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, i.ChannelId, "chan")
+	assert.Equal(t, i.ContainerId, "foo")
+	assert.Equal(t, i.Hash, "abc")
+	assert.Equal(t, i.Timeout, 10)
+
+	i, e = NewContainerStopCommandIntent("chan", []byte(`{"container_id": "foo", "timeout": 2}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, i.Timeout, 2)
+
+	// Try with wrong args
+	_, e = NewContainerStopCommandIntent("chan", []byte(`{"container_id": 123}`))
+	assert.Equal(t, e.Error(), "invalid input supplied for stopping container")
+	_, e = NewContainerStopCommandIntent("chan", []byte(`{"timeout": -1}`))
+	assert.Equal(t, e.Error(), "`container_id` is a required field\n`timeout` cannot be negative")
+	_, e = NewContainerStopCommandIntent("chan", []byte(`{"container_id": "foo", "timeout": 61}`))
+	assert.Equal(t, e.Error(), "`timeout` cannot be greater than 60")
+}
+
+func TestContainerCommandSignalIntent(t *testing.T) {
+	i, e := NewContainerCommandSignalIntent("foo", "cell", "exec", []byte(`{"signal": "SIGINT"}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, i.ContainerId, "foo")
+	assert.Equal(t, i.CellId, "cell")
+	assert.Equal(t, i.ExecId, "exec")
+	assert.Equal(t, i.Signal, "SIGINT")
+
+	// Short and lowercase names are normalized
+	i, e = NewContainerCommandSignalIntent("foo", "cell", "exec", []byte(`{"signal": "kill"}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, i.Signal, "SIGKILL")
+
+	// Try with wrong args
+	_, e = NewContainerCommandSignalIntent("foo", "cell", "exec", []byte(`{"signal": "SIGHUP"}`))
+	assert.Equal(t, e.Error(), "`signal` must be one of SIGINT, SIGTERM or SIGKILL")
+	_, e = NewContainerCommandSignalIntent("foo", "cell", "exec", []byte(`{}`))
+	assert.NotEqual(t, e, nil)
+}
+
+func TestContainerCommandResizeIntent(t *testing.T) {
+	i, e := NewContainerCommandResizeIntent("foo", "cell", "exec", []byte(`{"rows": 24, "cols": 80}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, i.ExecId, "exec")
+	assert.Equal(t, i.Rows, uint(24))
+	assert.Equal(t, i.Cols, uint(80))
+
+	// Try with wrong args
+	_, e = NewContainerCommandResizeIntent("foo", "cell", "exec", []byte(`{}`))
+	assert.Equal(t, e.Error(), "`rows` must be greater than 0\n`cols` must be greater than 0")
+	_, e = NewContainerCommandResizeIntent("foo", "cell", "exec", []byte(`{"rows": -1, "cols": 80}`))
+	assert.NotEqual(t, e, nil)
+}
+
+func TestContainerCommandReplayIntent(t *testing.T) {
+	i, e := NewContainerCommandReplayIntent("foo", "cell", "exec", []byte(`{"since": 12}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, i.ExecId, "exec")
+	assert.Equal(t, i.Since, uint64(12))
+
+	// Try with wrong args
+	_, e = NewContainerCommandReplayIntent("foo", "cell", "exec", []byte(`{"since": -1}`))
+	assert.NotEqual(t, e, nil)
+}
+
+func TestFinishedCommandReplayIntent(t *testing.T) {
+	i, e := NewFinishedCommandReplayIntent("foo", []byte(`{"cell_id": "cell", "exec_id": "exec", "since": 12, "request_id": "req"}`))
+	assert.Equal(t, e, nil)
+	assert.Equal(t, i.ContainerId, "foo")
+	assert.Equal(t, i.CellId, "cell")
+	assert.Equal(t, i.ExecId, "exec")
+	assert.Equal(t, i.Since, uint64(12))
+	assert.Equal(t, i.GetRequestId(), "req")
+
+	// Try with wrong args
+	_, e = NewFinishedCommandReplayIntent("foo", []byte(`{"since": 12}`))
+	assert.Equal(t, e.Error(), "`cell_id` is a required field\n`exec_id` is a required field")
+}
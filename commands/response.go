@@ -1,9 +1,28 @@
 package commands
 
+import (
+	"errors"
+	"fmt"
+)
+
 type ContainerStatusResponse struct {
 	Id     string `json:"id"`
 	Hash   string `json:"hash"`
 	Status string `json:"status"`
+	// Correlation id of the request the response is for, every response echoes it
+	RequestId string `json:"request_id,omitempty"`
+}
+
+// Progress of an image pull, reported per layer
+type ImagePullProgressResponse struct {
+	Image     string `json:"image"`
+	Hash      string `json:"hash"`
+	LayerId   string `json:"layer_id,omitempty"`
+	Status    string `json:"status"`
+	Current   int64  `json:"current,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Error     string `json:"error,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
 }
 
 type ContainerCommandStatusResponse struct {
@@ -11,6 +30,40 @@ type ContainerCommandStatusResponse struct {
 	CellId string `json:"cell_id"`
 	Status string `json:"status"`
 	Reason string `json:"reason"`
+	// Exit code of the command, only set once the command has completed
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Time taken by the command in milliseconds, only set once the command has completed
+	Duration int64 `json:"duration_ms,omitempty"`
+	// Exec that owned the cell before it was re-run, if any
+	PreviousExecId string `json:"previous_exec_id,omitempty"`
+	RequestId      string `json:"request_id,omitempty"`
+}
+
+// Sent when command output is dropped to stay under the max throughput
+type ContainerCommandOutputTruncatedResponse struct {
+	ExecId       string `json:"exec_id"`
+	CellId       string `json:"cell_id"`
+	Stream       string `json:"stream"`
+	DroppedBytes int    `json:"dropped_bytes"`
+	RequestId    string `json:"request_id,omitempty"`
+}
+
+// A single output message of a command, numbered in the order it was sent
+type CommandOutputEntry struct {
+	Seq       uint64 `json:"seq"`
+	EventName string `json:"event_name"`
+	Data      []byte `json:"data"`
+}
+
+// Output of a command that was sent after a given sequence number
+type ContainerCommandReplayResponse struct {
+	ExecId  string               `json:"exec_id"`
+	CellId  string               `json:"cell_id"`
+	Entries []CommandOutputEntry `json:"entries"`
+	// Set if some of the requested output is no longer held
+	Truncated bool   `json:"truncated"`
+	Error     string `json:"error,omitempty"`
+	RequestId string `json:"request_id,omitempty"`
 }
 
 type SyncFileResponse struct {
@@ -18,5 +71,52 @@ type SyncFileResponse struct {
 	FilePath   string `json:"file_path"`
 	Content    string `json:"content"`
 	CellId     string `json:"cell_id"`
+	Size       int    `json:"size,omitempty"`
 	Error      string `json:"error,omitempty"`
+	RequestId  string `json:"request_id,omitempty"`
+}
+
+// An error reported to the notebook on the error event. Errors are identified by their
+// code, the message is meant to be shown to users
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Id of the channel the error happened on, if any
+	ChannelId string `json:"channel_id,omitempty"`
+	// Correlation id of the request that caused the error, if any
+	RequestId string `json:"request_id,omitempty"`
+}
+
+func NewErrorResponse(code string, message string) *ErrorResponse {
+	return &ErrorResponse{Code: code, Message: message}
+}
+
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Errors with the same code match regardless of their channel and request, so that
+// errors.Is can be used against the errors returned by packages
+func (e *ErrorResponse) Is(target error) bool {
+	t, ok := target.(*ErrorResponse)
+	return ok && t.Code == e.Code
+}
+
+// Return a copy of the error that refers to a channel and request
+func (e *ErrorResponse) For(channelId string, requestId string) *ErrorResponse {
+	c := *e
+	c.ChannelId = channelId
+	c.RequestId = requestId
+	return &c
+}
+
+// Convert an error into an error response. Errors that are not error responses, such as
+// validation errors of intents, are reported with the given code
+func ToErrorResponse(err error, code string) *ErrorResponse {
+	var e *ErrorResponse
+	if errors.As(err, &e) {
+		c := *e
+		return &c
+	}
+	return NewErrorResponse(code, err.Error())
 }
@@ -0,0 +1,33 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponse(t *testing.T) {
+	base := NewErrorResponse("missing-channel", "There exists no channel with channelId foo")
+	e := base.For("foo", "req-1")
+	assert.Equal(t, e.Error(), "missing-channel: There exists no channel with channelId foo")
+	// The base error is left untouched
+	assert.Equal(t, base.ChannelId, "")
+	assert.True(t, errors.Is(e, base))
+	assert.False(t, errors.Is(e, NewErrorResponse("dup-channel", "")))
+	out, _ := json.Marshal(e)
+	assert.JSONEq(t, `{"code": "missing-channel", "message": "There exists no channel with channelId foo", "channel_id": "foo", "request_id": "req-1"}`, string(out))
+}
+
+func TestToErrorResponse(t *testing.T) {
+	base := NewErrorResponse("conn-closed", "Connection has been closed")
+	e := ToErrorResponse(fmt.Errorf("write failed: %w", base), "internal")
+	assert.Equal(t, e.Code, "conn-closed")
+	assert.NotSame(t, e, base)
+	// Other errors take the given code
+	e = ToErrorResponse(errors.New("`name` is a required field"), "invalid-request")
+	assert.Equal(t, e.Code, "invalid-request")
+	assert.Equal(t, e.Message, "`name` is a required field")
+}
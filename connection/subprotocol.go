@@ -3,10 +3,62 @@ package connection
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
-	"fmt"
+
+	"github.com/unklearn/notebook-backend/commands"
+)
+
+// Errors returned when a message cannot be decoded
+var (
+	ErrHeaderTooLong = commands.NewErrorResponse("enc-dec-header-too-long", "channel id or event name must be less than 256 characters")
+	ErrBadChannelId  = commands.NewErrorResponse("enc-dec-bad-channel-id", "Missing channel Id")
+	ErrBadEventName  = commands.NewErrorResponse("enc-dec-bad-event-name", "Missing event name")
+	ErrBadFrame      = commands.NewErrorResponse("enc-dec-bad-frame", "Frame is truncated or malformed")
+	ErrBadVersion    = commands.NewErrorResponse("enc-dec-bad-version", "Frame version does not match the negotiated subprotocol")
+	ErrFrameTooLarge = commands.NewErrorResponse("enc-dec-frame-too-large", "Frame exceeds the max frame size")
+)
+
+// Max length of channel ids and event names
+const maxNameSize = 256
+
+// Max size of a decoded frame in bytes. Frames carry file contents, so the limit is generous
+const DefaultMaxFrameSize = 16 * 1024 * 1024
+
+// Framing of multiplexed messages. Each version of the framing is a websocket subprotocol,
+// negotiated when the connection is upgraded
+type ISubprotocol interface {
+	Encode(channelId string, eventName string, message []byte) []byte
+	Decode(message []byte) (DecodedMxWebsocketResponse, error)
+	GetSubprotocol() string
+}
+
+const (
+	SubprotocolV1 = "unk.v1"
+	SubprotocolV2 = "unk.v2"
+	// Name used before subprotocols were versioned, it has the framing of v1
+	legacySubprotocol = "unk"
 )
 
+// Subprotocols offered during upgrade, in order of preference
+var Subprotocols = []string{SubprotocolV2, SubprotocolV1, legacySubprotocol}
+
+// Return the framing for a negotiated subprotocol, decoding frames of up to maxFrameSize
+// bytes. Clients that do not negotiate a subprotocol get v1, which is the framing they
+// were written against
+func GetSubprotocol(name string, maxFrameSize int) (ISubprotocol, bool) {
+	switch name {
+	case SubprotocolV2:
+		p := NewMxedWebsocketSubprotocolV2()
+		p.MaxFrameSize = maxFrameSize
+		return p, true
+	case SubprotocolV1, legacySubprotocol, "":
+		p := NewMxedWebsocketSubprotocol()
+		p.MaxFrameSize = maxFrameSize
+		return p, true
+	}
+	return nil, false
+}
+
+// Version 1 of the framing.
 // Multiplexed websocket encoder writes mulitplexed messages onto underlying socket for a mxed websocket
 // This creates a websocket subprotocol for client to use
 
@@ -18,6 +70,8 @@ import (
 //  The parsed lengths are used to read in channelId and eventName and payload
 type MxedWebsocketSubprotocol struct {
 	subProtocolName string
+	// Frames larger than this are rejected by Decode, 0 for no limit
+	MaxFrameSize int
 }
 
 // Holder for decoded messages
@@ -43,15 +97,28 @@ func (e MxedWebsocketSubprotocol) Encode(channelId string, eventName string, mes
 	return buf.Bytes()
 }
 
+// Decode a frame. Frames come from clients, so every length is checked against the
+// frame before it is used
 func (e MxedWebsocketSubprotocol) Decode(message []byte) (DecodedMxWebsocketResponse, error) {
 	r := DecodedMxWebsocketResponse{}
-	// Read first 4 bytes, then next 4
-	channelIdSize := int(binary.LittleEndian.Uint32(message[0:4]))
-	eventNameSize := int(binary.LittleEndian.Uint32(message[4:8]))
+	if e.MaxFrameSize > 0 && len(message) > e.MaxFrameSize {
+		return r, ErrFrameTooLarge
+	}
+	if len(message) < 8 {
+		return r, ErrBadFrame
+	}
+	// Read first 4 bytes, then next 4. Lengths stay unsigned until they are checked, an
+	// int conversion would turn large lengths negative on 32-bit builds
+	channelIdLen := uint64(binary.LittleEndian.Uint32(message[0:4]))
+	eventNameLen := uint64(binary.LittleEndian.Uint32(message[4:8]))
 	// Truncate sizes to a max so that we don't read out of bounds
-	if channelIdSize > 256 || eventNameSize > 256 {
-		return r, errors.New("channel id or event name must be less than 256 characters")
+	if channelIdLen > maxNameSize || eventNameLen > maxNameSize {
+		return r, ErrHeaderTooLong
+	}
+	if uint64(len(message)) < 8+channelIdLen+eventNameLen {
+		return r, ErrBadFrame
 	}
+	channelIdSize, eventNameSize := int(channelIdLen), int(eventNameLen)
 
 	// Parse channelId and eventName
 	r.ChannelId = string(message[8 : channelIdSize+8])
@@ -59,10 +126,10 @@ func (e MxedWebsocketSubprotocol) Decode(message []byte) (DecodedMxWebsocketResp
 	r.Payload = message[channelIdSize+eventNameSize+8:]
 
 	if r.ChannelId == "" {
-		return DecodedMxWebsocketResponse{}, fmt.Errorf("ECODE::enc-dec-bad-channel-id::Missing channel Id")
+		return DecodedMxWebsocketResponse{}, ErrBadChannelId
 	}
 	if r.EventName == "" {
-		return DecodedMxWebsocketResponse{}, fmt.Errorf("ECODE::enc-dec-bad-event-name::Missing event name")
+		return DecodedMxWebsocketResponse{}, ErrBadEventName
 	}
 	return r, nil
 }
@@ -73,5 +140,5 @@ func (e MxedWebsocketSubprotocol) GetSubprotocol() string {
 }
 
 func NewMxedWebsocketSubprotocol() *MxedWebsocketSubprotocol {
-	return &MxedWebsocketSubprotocol{subProtocolName: "unk"}
+	return &MxedWebsocketSubprotocol{subProtocolName: SubprotocolV1, MaxFrameSize: DefaultMaxFrameSize}
 }
@@ -0,0 +1,76 @@
+//go:build go1.18
+// +build go1.18
+
+package connection
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Seed frames for the decoders, including truncated and oversized headers
+var fuzzFrameSeeds = [][]byte{
+	{},
+	{4, 0, 0, 0},
+	{4, 0, 0, 0, 10, 0, 0, 0, 99, 104, 97, 110},
+	{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	{2, 0x80},
+	{2, 4, 10, 99, 104},
+	{2, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+}
+
+func fuzzSubprotocols() []ISubprotocol {
+	return []ISubprotocol{NewMxedWebsocketSubprotocol(), NewMxedWebsocketSubprotocolV2()}
+}
+
+// Decoding arbitrary frames never panics, and frames that decode encode back to an
+// equivalent frame
+func FuzzMxedWebsocketDecode(f *testing.F) {
+	for _, seed := range fuzzFrameSeeds {
+		f.Add(seed)
+	}
+	for _, p := range fuzzSubprotocols() {
+		f.Add(p.Encode("chan", "event-name", []byte("oyo koyo muntoyo")))
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		for _, p := range fuzzSubprotocols() {
+			d, err := p.Decode(frame)
+			if err != nil {
+				continue
+			}
+			again, err := p.Decode(p.Encode(d.ChannelId, d.EventName, d.Payload))
+			if err != nil {
+				t.Fatalf("%s: re-encoded frame does not decode: %s", p.GetSubprotocol(), err)
+			}
+			if again.ChannelId != d.ChannelId || again.EventName != d.EventName || !bytes.Equal(again.Payload, d.Payload) {
+				t.Fatalf("%s: re-encoded frame decodes to %#v, expected %#v", p.GetSubprotocol(), again, d)
+			}
+		}
+	})
+}
+
+// Messages with a valid channel id and event name survive an Encode/Decode round trip
+func FuzzMxedWebsocketRoundTrip(f *testing.F) {
+	f.Add("chan", "event-name", []byte("oyo koyo muntoyo"))
+	f.Add("c", "e", []byte{})
+	f.Add("", "event-name", []byte("oyo"))
+	f.Add("chan", "", []byte("oyo"))
+	f.Fuzz(func(t *testing.T, channelId string, eventName string, payload []byte) {
+		valid := channelId != "" && eventName != "" && len(channelId) <= maxNameSize && len(eventName) <= maxNameSize
+		for _, p := range fuzzSubprotocols() {
+			d, err := p.Decode(p.Encode(channelId, eventName, payload))
+			if !valid {
+				if err == nil {
+					t.Fatalf("%s: expected an error for channel id %q and event name %q", p.GetSubprotocol(), channelId, eventName)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: round trip failed: %s", p.GetSubprotocol(), err)
+			}
+			if d.ChannelId != channelId || d.EventName != eventName || !bytes.Equal(d.Payload, payload) {
+				t.Fatalf("%s: round trip decodes to %#v", p.GetSubprotocol(), d)
+			}
+		}
+	})
+}
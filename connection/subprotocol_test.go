@@ -2,6 +2,11 @@ package connection
 
 import (
 	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,9 +24,17 @@ func TestMxedWebsocketEncoder(t *testing.T) {
 func TestMxedWebsocketDecoderLargeSizeLimit(t *testing.T) {
 	e := NewMxedWebsocketSubprotocol()
 	_, err := e.Decode([]byte{0, 0, 0, 4, 10, 0, 0, 0, 99, 104, 97, 110, 101, 118, 101, 110, 116, 45, 110, 97, 109, 101, 111, 121, 111, 32, 107, 111, 121, 111, 32, 109, 117, 110, 116, 111, 121, 111})
-	assert.NotEqual(t, err, nil)
+	assert.Equal(t, err, ErrHeaderTooLong)
 	_, err = e.Decode([]byte{4, 0, 0, 0, 0, 0, 0, 10, 99, 104, 97, 110, 101, 118, 101, 110, 116, 45, 110, 97, 109, 101, 111, 121, 111, 32, 107, 111, 121, 111, 32, 109, 117, 110, 116, 111, 121, 111})
-	assert.NotEqual(t, err, nil)
+	assert.Equal(t, err, ErrHeaderTooLong)
+}
+
+func TestMxedWebsocketDecoderMissingNames(t *testing.T) {
+	e := NewMxedWebsocketSubprotocol()
+	_, err := e.Decode(e.Encode("", "event-name", []byte("payload")))
+	assert.Equal(t, err, ErrBadChannelId)
+	_, err = e.Decode(e.Encode("chan", "", []byte("payload")))
+	assert.Equal(t, err, ErrBadEventName)
 }
 
 func TestMxedWebsocketDecoder(t *testing.T) {
@@ -37,3 +50,109 @@ func TestMxedWebsocketDecoder(t *testing.T) {
 		t.Errorf("Expected decoded payload to match %v", res.Payload)
 	}
 }
+
+func TestMxedWebsocketSubprotocolV2(t *testing.T) {
+	e := NewMxedWebsocketSubprotocolV2()
+	assert.Equal(t, e.GetSubprotocol(), SubprotocolV2)
+	res := e.Encode("chan", "event-name", []byte("oyo"))
+	assert.Equal(t, res, []byte{2, 4, 10, 99, 104, 97, 110, 101, 118, 101, 110, 116, 45, 110, 97, 109, 101, 111, 121, 111})
+	d, err := e.Decode(res)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, d.ChannelId, "chan")
+	assert.Equal(t, d.EventName, "event-name")
+	assert.Equal(t, d.Payload, []byte("oyo"))
+}
+
+func TestMxedWebsocketSubprotocolV2Errors(t *testing.T) {
+	e := NewMxedWebsocketSubprotocolV2()
+	_, err := e.Decode([]byte{})
+	assert.Equal(t, err, ErrBadFrame)
+	// A v1 frame is rejected by the v2 decoder
+	_, err = e.Decode(NewMxedWebsocketSubprotocol().Encode("chan", "event-name", []byte("oyo")))
+	assert.Equal(t, err, ErrBadVersion)
+	// Lengths that run past the end of the frame
+	_, err = e.Decode([]byte{2, 4, 10, 99, 104})
+	assert.Equal(t, err, ErrBadFrame)
+	_, err = e.Decode([]byte{2, 0x80})
+	assert.Equal(t, err, ErrBadFrame)
+	_, err = e.Decode([]byte{2, 0x80, 0x04, 1, 99})
+	assert.Equal(t, err, ErrHeaderTooLong)
+	_, err = e.Decode(e.Encode("", "event-name", nil))
+	assert.Equal(t, err, ErrBadChannelId)
+	_, err = e.Decode(e.Encode("chan", "", nil))
+	assert.Equal(t, err, ErrBadEventName)
+}
+
+func TestGetSubprotocol(t *testing.T) {
+	for _, name := range []string{SubprotocolV1, "unk", ""} {
+		p, ok := GetSubprotocol(name, DefaultMaxFrameSize)
+		assert.Equal(t, ok, true)
+		assert.Equal(t, p.GetSubprotocol(), SubprotocolV1)
+	}
+	p, ok := GetSubprotocol(SubprotocolV2, DefaultMaxFrameSize)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, p.GetSubprotocol(), SubprotocolV2)
+	_, ok = GetSubprotocol("unk.v3", DefaultMaxFrameSize)
+	assert.Equal(t, ok, false)
+	// Every offered subprotocol can be served
+	for _, name := range Subprotocols {
+		_, ok := GetSubprotocol(name, DefaultMaxFrameSize)
+		assert.Equal(t, ok, true)
+	}
+}
+
+func TestMxedWebsocketDecoderBounds(t *testing.T) {
+	e := NewMxedWebsocketSubprotocol()
+	// Frames shorter than the length header
+	for _, frame := range [][]byte{nil, {}, {4, 0, 0, 0}, {4, 0, 0, 0, 10, 0, 0}} {
+		_, err := e.Decode(frame)
+		assert.Equal(t, err, ErrBadFrame)
+	}
+	// Lengths that run past the end of the frame
+	_, err := e.Decode([]byte{4, 0, 0, 0, 10, 0, 0, 0, 99, 104, 97, 110, 101, 118})
+	assert.Equal(t, err, ErrBadFrame)
+	_, err = e.Decode([]byte{4, 0, 0, 0, 0, 0, 0, 0, 99})
+	assert.Equal(t, err, ErrBadFrame)
+	// Lengths that overflow when read as a signed int
+	_, err = e.Decode([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	assert.Equal(t, err, ErrHeaderTooLong)
+	for _, frame := range [][]byte{
+		{0xff, 0xff, 0xff, 0xff, 4, 0, 0, 0, 99, 104, 97, 110},
+		{4, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 99, 104, 97, 110},
+		{0, 0, 0, 0x80, 0, 0, 0, 0x80, 99},
+	} {
+		_, err = e.Decode(frame)
+		assert.Equal(t, err, ErrHeaderTooLong)
+	}
+}
+
+// Lengths decoded as int are negative on 32-bit builds, run the bounds checks there too
+func TestMxedWebsocketDecoderBounds32Bit(t *testing.T) {
+	if runtime.GOARCH == "386" || testing.Short() {
+		t.Skip("already running on a 32-bit build")
+	}
+	goBin := filepath.Join(runtime.GOROOT(), "bin", "go")
+	cmd := exec.Command(goBin, "test", "-run", "TestMxedWebsocketDecoder", ".")
+	cmd.Env = append(os.Environ(), "GOARCH=386", "CGO_ENABLED=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil && strings.Contains(string(out), "unsupported GOOS/GOARCH") {
+		t.Skip("386 builds are not supported on this platform")
+	}
+	assert.Equal(t, err, nil, string(out))
+}
+
+func TestMxedWebsocketDecoderMaxFrameSize(t *testing.T) {
+	for _, e := range []ISubprotocol{
+		&MxedWebsocketSubprotocol{subProtocolName: SubprotocolV1, MaxFrameSize: 32},
+		&MxedWebsocketSubprotocolV2{subProtocolName: SubprotocolV2, MaxFrameSize: 32},
+	} {
+		_, err := e.Decode(e.Encode("chan", "event-name", []byte("oyo")))
+		assert.Equal(t, err, nil)
+		_, err = e.Decode(e.Encode("chan", "event-name", bytes.Repeat([]byte("o"), 32)))
+		assert.Equal(t, err, ErrFrameTooLarge)
+	}
+	// A max frame size of 0 has no limit
+	p, _ := GetSubprotocol(SubprotocolV1, 0)
+	_, err := p.Decode(p.Encode("chan", "event-name", bytes.Repeat([]byte("o"), DefaultMaxFrameSize+1)))
+	assert.Equal(t, err, nil)
+}
@@ -0,0 +1,84 @@
+package connection
+
+import (
+	"encoding/binary"
+)
+
+// Version byte that starts every v2 frame
+const subprotocolV2Version = 2
+
+// Version 2 of the framing. Frames start with a version byte, so that a frame sent with
+// the wrong framing is rejected rather than misread, and lengths are uvarints
+//
+//	|-version-|-channelId length-|-eventName length-|-------channelId---------|--------eventName--------|payload
+//
+// The version is a single byte, the lengths are unsigned varints as written by binary.PutUvarint
+type MxedWebsocketSubprotocolV2 struct {
+	subProtocolName string
+	// Frames larger than this are rejected by Decode, 0 for no limit
+	MaxFrameSize int
+}
+
+// Encode writes to a given channel and eventName by encoding the version and lengths
+func (e MxedWebsocketSubprotocolV2) Encode(channelId string, eventName string, message []byte) []byte {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64, 1+2*binary.MaxVarintLen64+len(channelId)+len(eventName)+len(message))
+	buf[0] = subprotocolV2Version
+	n := 1
+	n += binary.PutUvarint(buf[n:], uint64(len(channelId)))
+	n += binary.PutUvarint(buf[n:], uint64(len(eventName)))
+	buf = buf[:n]
+	buf = append(buf, channelId...)
+	buf = append(buf, eventName...)
+	return append(buf, message...)
+}
+
+// Decode a frame. Frames come from clients, so every length is checked against the
+// frame before it is used
+func (e MxedWebsocketSubprotocolV2) Decode(message []byte) (DecodedMxWebsocketResponse, error) {
+	r := DecodedMxWebsocketResponse{}
+	if e.MaxFrameSize > 0 && len(message) > e.MaxFrameSize {
+		return r, ErrFrameTooLarge
+	}
+	if len(message) == 0 {
+		return r, ErrBadFrame
+	}
+	if message[0] != subprotocolV2Version {
+		return r, ErrBadVersion
+	}
+	rest := message[1:]
+	channelIdSize, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return r, ErrBadFrame
+	}
+	rest = rest[n:]
+	eventNameSize, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return r, ErrBadFrame
+	}
+	rest = rest[n:]
+	if channelIdSize > maxNameSize || eventNameSize > maxNameSize {
+		return r, ErrHeaderTooLong
+	}
+	if uint64(len(rest)) < channelIdSize+eventNameSize {
+		return r, ErrBadFrame
+	}
+	r.ChannelId = string(rest[:channelIdSize])
+	r.EventName = string(rest[channelIdSize : channelIdSize+eventNameSize])
+	r.Payload = rest[channelIdSize+eventNameSize:]
+	if r.ChannelId == "" {
+		return DecodedMxWebsocketResponse{}, ErrBadChannelId
+	}
+	if r.EventName == "" {
+		return DecodedMxWebsocketResponse{}, ErrBadEventName
+	}
+	return r, nil
+}
+
+// Return the subprotocol name for the encoder
+func (e MxedWebsocketSubprotocolV2) GetSubprotocol() string {
+	return e.subProtocolName
+}
+
+func NewMxedWebsocketSubprotocolV2() *MxedWebsocketSubprotocolV2 {
+	return &MxedWebsocketSubprotocolV2{subProtocolName: SubprotocolV2, MaxFrameSize: DefaultMaxFrameSize}
+}
@@ -1,35 +1,195 @@
 package connection
 
-import "github.com/unklearn/notebook-backend/channels"
+import (
+	"sync"
+	"time"
+
+	"github.com/unklearn/notebook-backend/commands"
+)
 
 type IWebsocketConn interface {
 	WriteMessage(messageType int, payload []byte) error
 	ReadMessage() (messageType int, message []byte, err error)
+	// Writes that have not completed by the deadline fail, a zero time means no deadline
+	SetWriteDeadline(t time.Time) error
+	Close() error
 }
 
+// Websocket message type used for multiplexed messages
+const binaryMessageType = 2
+
+var (
+	ErrConnectionClosed = commands.NewErrorResponse("conn-closed", "Connection has been closed")
+	ErrSlowConsumer     = commands.NewErrorResponse("slow-consumer", "Outbound queue is full")
+)
+
+// Policy applied when the outbound queue of a connection is full, which happens
+// when the client reads slower than commands produce output
+type SlowConsumerPolicy int
+
+const (
+	// Block writers until there is room in the outbound queue
+	BlockSlowConsumer SlowConsumerPolicy = iota
+	// Drop messages that do not fit in the outbound queue
+	DropSlowConsumer
+	// Close the connection once the outbound queue is full
+	DisconnectSlowConsumer
+)
+
+type MxedWebsocketConnOptions struct {
+	// Number of messages that can be queued before the slow consumer policy applies
+	QueueSize int
+	Policy    SlowConsumerPolicy
+	// Framing of messages, as negotiated during upgrade. Defaults to v1 if nil
+	Protocol ISubprotocol
+	// A write that takes longer fails and closes the connection, so that a client that
+	// stopped reading cannot hold up the writer. Close waits at most this long for queued
+	// messages to be flushed. 0 disables both limits
+	WriteTimeout time.Duration
+}
+
+var DefaultMxedWebsocketConnOptions = MxedWebsocketConnOptions{QueueSize: 256, Policy: BlockSlowConsumer, WriteTimeout: 10 * time.Second}
+
 // A multiplexed websocket connection that is capable of writing logs and command outputs to
 // a single websocket connection
 type MxedWebsocketConn struct {
 	// The underlying original websocket connection
 	conn     IWebsocketConn
-	protocol *MxedWebsocketSubprotocol
+	protocol ISubprotocol
 	Id       string
-	*channels.Registry
+	options  MxedWebsocketConnOptions
+	// Encoded messages waiting to be written by the writer goroutine. The underlying
+	// connection supports a single writer, so all writes go through this queue
+	outbound chan []byte
+	// Closed when the connection is closed or has failed
+	done      chan struct{}
+	closeOnce sync.Once
+	// Closed once the writer goroutine has exited
+	writerDone chan struct{}
+	// First error that caused the connection to close
+	mu  sync.Mutex
+	err error
 }
 
 func NewMxedWebsocketConn(conn IWebsocketConn, id string) *MxedWebsocketConn {
-	return &MxedWebsocketConn{conn: conn, protocol: NewMxedWebsocketSubprotocol(), Id: id, Registry: &channels.Registry{}}
+	return NewMxedWebsocketConnWithOptions(conn, id, DefaultMxedWebsocketConnOptions)
+}
+
+func NewMxedWebsocketConnWithOptions(conn IWebsocketConn, id string, options MxedWebsocketConnOptions) *MxedWebsocketConn {
+	protocol := options.Protocol
+	if protocol == nil {
+		protocol = NewMxedWebsocketSubprotocol()
+	}
+	mx := &MxedWebsocketConn{
+		conn:       conn,
+		protocol:   protocol,
+		Id:         id,
+		options:    options,
+		outbound:   make(chan []byte, options.QueueSize),
+		done:       make(chan struct{}),
+		writerDone: make(chan struct{}),
+	}
+	go mx.writeLoop()
+	return mx
+}
+
+// Write queued messages onto the underlying connection until the connection is closed.
+// Messages queued before close are flushed
+func (mx *MxedWebsocketConn) writeLoop() {
+	defer close(mx.writerDone)
+	for {
+		select {
+		case output := <-mx.outbound:
+			if err := mx.write(output); err != nil {
+				mx.fail(err)
+				return
+			}
+		case <-mx.done:
+			for {
+				select {
+				case output := <-mx.outbound:
+					if err := mx.write(output); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Write a message onto the underlying connection within the write timeout
+func (mx *MxedWebsocketConn) write(output []byte) error {
+	if mx.options.WriteTimeout > 0 {
+		if err := mx.conn.SetWriteDeadline(time.Now().Add(mx.options.WriteTimeout)); err != nil {
+			return err
+		}
+	}
+	return mx.conn.WriteMessage(binaryMessageType, output)
+}
+
+// Return the name of the subprotocol used to frame messages
+func (mx *MxedWebsocketConn) Subprotocol() string {
+	return mx.protocol.GetSubprotocol()
+}
+
+// Record the error that broke the connection and close it
+func (mx *MxedWebsocketConn) fail(err error) {
+	mx.mu.Lock()
+	if mx.err == nil {
+		mx.err = err
+	}
+	mx.mu.Unlock()
+	mx.closeOnce.Do(func() {
+		close(mx.done)
+	})
+	mx.conn.Close()
+}
+
+// Return the error that closed the connection
+func (mx *MxedWebsocketConn) closedErr() error {
+	mx.mu.Lock()
+	defer mx.mu.Unlock()
+	if mx.err != nil {
+		return mx.err
+	}
+	return ErrConnectionClosed
 }
 
 // Override the default write message to multiplex the message over a channelId. Messages
 // sent over this channel will only reach the corresponding mxed websocket listening on
 // this channel
-// messageType indicates type of websocket message: text or binary.
 // channelId & eventName can be used to target specific channels and actions.
-func (mx *MxedWebsocketConn) WriteMessage(channelId string, eventName string, message []byte) {
+// Messages are queued and written by a single writer, an error is returned if the
+// connection has been closed, or if the message was rejected by the slow consumer policy
+func (mx *MxedWebsocketConn) WriteMessage(channelId string, eventName string, message []byte) error {
 	// Encode channelId and eventName and bytes with encoder
 	output := mx.protocol.Encode(channelId, eventName, message)
-	mx.conn.WriteMessage(2, output)
+	select {
+	case <-mx.done:
+		return mx.closedErr()
+	default:
+	}
+	if mx.options.Policy == BlockSlowConsumer {
+		select {
+		case mx.outbound <- output:
+			return nil
+		case <-mx.done:
+			return mx.closedErr()
+		}
+	}
+	select {
+	case mx.outbound <- output:
+		return nil
+	case <-mx.done:
+		return mx.closedErr()
+	default:
+	}
+	if mx.options.Policy == DisconnectSlowConsumer {
+		mx.fail(ErrSlowConsumer)
+	}
+	return ErrSlowConsumer
 }
 
 // Read message and return the appropriate channelId, eventName etc
@@ -44,3 +204,23 @@ func (mx *MxedWebsocketConn) ReadMessage() (DecodedMxWebsocketResponse, error) {
 	}
 	return decoded, nil
 }
+
+// Close the connection after flushing queued messages. Messages that cannot be flushed
+// within the write timeout are dropped. Calling Close more than once is a no-op
+func (mx *MxedWebsocketConn) Close() error {
+	mx.closeOnce.Do(func() {
+		close(mx.done)
+	})
+	if mx.options.WriteTimeout > 0 {
+		timer := time.NewTimer(mx.options.WriteTimeout)
+		defer timer.Stop()
+		select {
+		case <-mx.writerDone:
+		case <-timer.C:
+			// Closing the underlying connection fails the write in progress
+		}
+	} else {
+		<-mx.writerDone
+	}
+	return mx.conn.Close()
+}
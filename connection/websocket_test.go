@@ -1,7 +1,10 @@
 package connection
 
 import (
+	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -9,6 +12,7 @@ import (
 type fakeWebsocketConn struct {
 	intake    []byte
 	intBuffer []byte
+	closed    bool
 }
 
 func (f *fakeWebsocketConn) WriteMessage(messageType int, payload []byte) error {
@@ -21,12 +25,79 @@ func (f fakeWebsocketConn) ReadMessage() (messageType int, payload []byte, err e
 	return 0, f.intake, nil
 }
 
+func (f *fakeWebsocketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (f *fakeWebsocketConn) Close() error {
+	f.closed = true
+	return nil
+}
+
+// A websocket conn whose writes block until released, to simulate slow consumers.
+// Blocked writes fail once the write deadline passes, unless deadlines are ignored
+type blockingWebsocketConn struct {
+	mu       sync.Mutex
+	release  chan struct{}
+	written  [][]byte
+	writeErr error
+	closed   bool
+	deadline time.Time
+	// Set to simulate a connection that hangs past its deadline
+	ignoreDeadline bool
+}
+
+var errWriteTimeout = errors.New("i/o timeout")
+
+func (b *blockingWebsocketConn) WriteMessage(messageType int, payload []byte) error {
+	b.mu.Lock()
+	var timeout <-chan time.Time
+	if !b.deadline.IsZero() && !b.ignoreDeadline {
+		timer := time.NewTimer(time.Until(b.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	b.mu.Unlock()
+	select {
+	case <-b.release:
+	case <-timeout:
+		return errWriteTimeout
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.written = append(b.written, payload)
+	return b.writeErr
+}
+
+func (b *blockingWebsocketConn) SetWriteDeadline(t time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadline = t
+	return nil
+}
+
+func (b *blockingWebsocketConn) ReadMessage() (messageType int, payload []byte, err error) {
+	return 0, nil, nil
+}
+
+func (b *blockingWebsocketConn) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
 func TestMxedWebsocketWriteMessage(t *testing.T) {
 	f := &fakeWebsocketConn{intake: []byte("wohoo")}
 	sub := NewMxedWebsocketSubprotocol()
 	mx := NewMxedWebsocketConn(f, "id")
-	mx.WriteMessage("chan", "some-event", []byte("woohoo"))
+	e := mx.WriteMessage("chan", "some-event", []byte("woohoo"))
+	assert.Equal(t, e, nil)
+	// Close flushes queued messages
+	mx.Close()
 	assert.Equal(t, f.intBuffer, sub.Encode("chan", "some-event", []byte("woohoo")))
+	assert.Equal(t, f.closed, true)
+	assert.Equal(t, mx.WriteMessage("chan", "some-event", []byte("woohoo")), ErrConnectionClosed)
 }
 
 func TestMxedWebsocketRead(t *testing.T) {
@@ -40,3 +111,111 @@ func TestMxedWebsocketRead(t *testing.T) {
 	assert.Equal(t, d.EventName, "some-event")
 	assert.Equal(t, d.Payload, []byte("woohoo"))
 }
+
+func TestMxedWebsocketNegotiatedSubprotocol(t *testing.T) {
+	sub := NewMxedWebsocketSubprotocolV2()
+	f := &fakeWebsocketConn{intake: sub.Encode("chan", "some-event", []byte("woohoo"))}
+	options := DefaultMxedWebsocketConnOptions
+	options.Protocol = sub
+	mx := NewMxedWebsocketConnWithOptions(f, "id", options)
+	assert.Equal(t, mx.Subprotocol(), SubprotocolV2)
+	d, err := mx.ReadMessage()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, d.ChannelId, "chan")
+	mx.WriteMessage("chan", "some-event", []byte("woohoo"))
+	mx.Close()
+	assert.Equal(t, f.intBuffer, sub.Encode("chan", "some-event", []byte("woohoo")))
+	// Connections default to v1
+	assert.Equal(t, NewMxedWebsocketConn(f, "id").Subprotocol(), SubprotocolV1)
+}
+
+func TestMxedWebsocketConcurrentWrites(t *testing.T) {
+	b := &blockingWebsocketConn{release: make(chan struct{})}
+	close(b.release)
+	mx := NewMxedWebsocketConn(b, "id")
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mx.WriteMessage("chan", "some-event", []byte("woohoo"))
+		}()
+	}
+	wg.Wait()
+	mx.Close()
+	assert.Equal(t, len(b.written), 100)
+}
+
+func TestMxedWebsocketDropSlowConsumer(t *testing.T) {
+	b := &blockingWebsocketConn{release: make(chan struct{})}
+	mx := NewMxedWebsocketConnWithOptions(b, "id", MxedWebsocketConnOptions{QueueSize: 1, Policy: DropSlowConsumer})
+	// The writer holds one message while it is blocked, the queue holds another
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = mx.WriteMessage("chan", "some-event", []byte("woohoo"))
+	}
+	assert.Equal(t, err, ErrSlowConsumer)
+	close(b.release)
+	mx.Close()
+}
+
+func TestMxedWebsocketDisconnectSlowConsumer(t *testing.T) {
+	b := &blockingWebsocketConn{release: make(chan struct{})}
+	mx := NewMxedWebsocketConnWithOptions(b, "id", MxedWebsocketConnOptions{QueueSize: 1, Policy: DisconnectSlowConsumer})
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = mx.WriteMessage("chan", "some-event", []byte("woohoo"))
+	}
+	assert.Equal(t, err, ErrSlowConsumer)
+	assert.Equal(t, b.closed, true)
+	// Once disconnected, writes report why the connection was closed
+	assert.Equal(t, mx.WriteMessage("chan", "some-event", []byte("woohoo")), ErrSlowConsumer)
+	close(b.release)
+	mx.Close()
+}
+
+func TestMxedWebsocketWriteError(t *testing.T) {
+	writeErr := errors.New("broken pipe")
+	b := &blockingWebsocketConn{release: make(chan struct{}), writeErr: writeErr}
+	close(b.release)
+	mx := NewMxedWebsocketConn(b, "id")
+	mx.WriteMessage("chan", "some-event", []byte("woohoo"))
+	<-mx.writerDone
+	assert.Equal(t, mx.WriteMessage("chan", "some-event", []byte("woohoo")), writeErr)
+	assert.Equal(t, b.closed, true)
+}
+
+func TestMxedWebsocketWriteTimeout(t *testing.T) {
+	b := &blockingWebsocketConn{release: make(chan struct{})}
+	mx := NewMxedWebsocketConnWithOptions(b, "id", MxedWebsocketConnOptions{QueueSize: 1, WriteTimeout: time.Millisecond * 20})
+	assert.Equal(t, mx.WriteMessage("chan", "some-event", []byte("woohoo")), nil)
+	// A client that stops reading fails the write, and the connection is closed
+	select {
+	case <-mx.writerDone:
+	case <-time.After(time.Second * 5):
+		t.Fatal("write did not time out")
+	}
+	assert.Equal(t, mx.WriteMessage("chan", "some-event", []byte("woohoo")), errWriteTimeout)
+	assert.Equal(t, b.closed, true)
+}
+
+func TestMxedWebsocketCloseTimeout(t *testing.T) {
+	b := &blockingWebsocketConn{release: make(chan struct{}), ignoreDeadline: true}
+	defer close(b.release)
+	mx := NewMxedWebsocketConnWithOptions(b, "id", MxedWebsocketConnOptions{QueueSize: 1, WriteTimeout: time.Millisecond * 20})
+	mx.WriteMessage("chan", "some-event", []byte("woohoo"))
+	// Close does not wait for a write that hangs
+	closed := make(chan struct{})
+	go func() {
+		mx.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("close waited for a hung write")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	assert.Equal(t, b.closed, true)
+}
@@ -1,18 +1,30 @@
 package containerservices
 
 import (
-	"bufio"
+	"archive/tar"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
+	"github.com/google/uuid"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/unklearn/notebook-backend/channels"
 	"github.com/unklearn/notebook-backend/commands"
@@ -25,14 +37,18 @@ type DockerContainerService struct {
 	// Stores a map of networks associated with docker daemon.
 	// Allows notebooks/channels to create user defined networks
 	networkMap map[string]types.NetworkResource
+	// Credentials used to authenticate image pulls
+	credentials *RegistryCredentialStore
+	// Maps the exec id of running commands to the pid file they write inside the container
+	pidFiles *sync.Map
 }
 
 func (dcs DockerContainerService) GetClient() *client.Client {
 	return dcs.client
 }
 
-func NewDockerContainerService(c *client.Client) *DockerContainerService {
-	return &DockerContainerService{client: c}
+func NewDockerContainerService(c *client.Client, credentials *RegistryCredentialStore) *DockerContainerService {
+	return &DockerContainerService{client: c, credentials: credentials, pidFiles: &sync.Map{}}
 }
 
 const NETWORK_NAME = "unk_default_network"
@@ -60,15 +76,70 @@ func (dcs DockerContainerService) createNetworkForChannel(ctx context.Context) (
 	}
 }
 
-func (dcs DockerContainerService) EnsureImage(ctx context.Context, image string, tag string, repoUrl string) error {
-	// TODO: Use repoUrl
-	_, e := dcs.client.ImageList(ctx, types.ImageListOptions{All: true})
+// Return the reference used to pull and run an image. If repoUrl is empty, the
+// reference resolves against docker hub
+func imageReference(image string, tag string, repoUrl string) string {
+	ref := fmt.Sprintf("%s:%s", image, tag)
+	repoUrl = strings.TrimPrefix(strings.TrimPrefix(repoUrl, "https://"), "http://")
+	repoUrl = strings.TrimSuffix(repoUrl, "/")
+	if repoUrl == "" {
+		return ref
+	}
+	return repoUrl + "/" + ref
+}
+
+// Ensure that the image exists on the docker host, pulling it if it is missing. Pull
+// progress is reported to the progress callback as it is streamed from the daemon
+func (dcs DockerContainerService) EnsureImage(ctx context.Context, intent commands.ImagePullCommandIntent, progress func(commands.ImagePullProgressResponse)) error {
+	ref := imageReference(intent.Image, intent.Tag, intent.RepoUrl)
+	_, _, e := dcs.client.ImageInspectWithRaw(ctx, ref)
+	if e == nil {
+		return nil
+	}
+	if !errdefs.IsNotFound(e) {
+		return e
+	}
+	auth, e := dcs.credentials.EncodedAuthFor(ref)
+	if e != nil {
+		return e
+	}
+	rc, e := dcs.client.ImagePull(ctx, ref, types.ImagePullOptions{RegistryAuth: auth})
 	if e != nil {
 		return e
 	}
+	defer rc.Close()
+	return decodePullProgress(rc, ref, intent.Hash, progress)
+}
+
+// Decode the JSON messages of an image pull, reporting the progress of each layer.
+// An error message from the docker daemon fails the pull
+func decodePullProgress(r io.Reader, ref string, hash string, progress func(commands.ImagePullProgressResponse)) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var msg jsonmessage.JSONMessage
+		if e := decoder.Decode(&msg); e != nil {
+			if e == io.EOF {
+				break
+			}
+			return e
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		p := commands.ImagePullProgressResponse{Image: ref, Hash: hash, LayerId: msg.ID, Status: msg.Status}
+		if msg.Progress != nil {
+			p.Current = msg.Progress.Current
+			p.Total = msg.Progress.Total
+		}
+		progress(p)
+	}
 	return nil
 }
 
+// Label that records the notebook a container was created for. Notebooks can only
+// attach to containers that carry their own id
+const NotebookLabel = "unk.notebook"
+
 // Return the status of a running container. If container is missing
 // error is returned
 func (dcs DockerContainerService) GetContainerStatus(ctx context.Context, containerId string) (string, error) {
@@ -79,6 +150,19 @@ func (dcs DockerContainerService) GetContainerStatus(ctx context.Context, contai
 	return ctr.State.Status, nil
 }
 
+// Return the id of the notebook a container was created for, or an empty id if the
+// container was not created by a notebook. If container is missing error is returned
+func (dcs DockerContainerService) GetContainerNotebook(ctx context.Context, containerId string) (string, error) {
+	ctr, e := dcs.client.ContainerInspect(ctx, containerId)
+	if e != nil {
+		return "", e
+	}
+	if ctr.Config == nil {
+		return "", nil
+	}
+	return ctr.Config.Labels[NotebookLabel], nil
+}
+
 // Create a new docker container with given image and tag
 // Returns containerId and err if any
 func (dcs DockerContainerService) CreateNew(ctx context.Context, intent commands.ContainerCreateCommandIntent) (string, error) {
@@ -93,10 +177,11 @@ func (dcs DockerContainerService) CreateNew(ctx context.Context, intent commands
 		}}
 	}
 	ctrConfig := container.Config{
-		Image:        fmt.Sprintf("%s:%s", intent.Image, intent.ImageTag),
+		Image:        imageReference(intent.Image, intent.ImageTag, intent.RepoUrl),
 		Cmd:          intent.Command,
 		Env:          intent.EnvVars,
 		ExposedPorts: exposedPorts,
+		Labels:       map[string]string{NotebookLabel: intent.ChannelId},
 	}
 	hostConfig := container.HostConfig{
 		AutoRemove:   true,
@@ -126,53 +211,58 @@ func (dcs DockerContainerService) CreateNew(ctx context.Context, intent commands
 	return resp.ID, err
 }
 
-func writeToHijackedResponseConn(writeChan chan []byte, conn net.Conn) {
-	for data := range writeChan {
-		conn.Write(data)
+// Stop a running container, giving it timeout to exit gracefully before it is killed.
+// The container is removed afterwards, if it has not been auto-removed already
+func (dcs DockerContainerService) StopContainer(ctx context.Context, containerId string, timeout time.Duration) error {
+	err := dcs.client.ContainerStop(ctx, containerId, &timeout)
+	if err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	err = dcs.client.ContainerRemove(ctx, containerId, types.ContainerRemoveOptions{Force: true})
+	// Containers are created with AutoRemove, so removal may be in progress or done
+	if err != nil && !errdefs.IsNotFound(err) && !errdefs.IsConflict(err) {
+		return err
 	}
+	return nil
 }
 
-func listenForHijackedResponseReader(readChan chan []byte, reader *bufio.Reader) {
-	// Listen for messages on exec-reader
-	b := make([]byte, 1024)
-	//ticker := time.NewTicker(time.Millisecond * 100)
+func writeToHijackedResponseConn(conduit *channels.BidirectionalContainerConduit, conn net.Conn) {
 	for {
-		n, err := reader.Read(b)
-		if err == io.EOF {
-			break
-		}
-		// Wait for next set
-		// <-ticker.C
-		if len(b) > 0 {
-			readChan <- b[:n]
+		select {
+		case data := <-conduit.WriteChan:
+			conn.Write(data)
+		case <-conduit.Done():
+			return
 		}
 	}
 }
 
-func wrapHijackedResponseIntoConduit(resp types.HijackedResponse, execId string) *channels.BidirectionalContainerConduit {
-	// TODO: Move into constructor func
-	readChan := make(chan []byte)
-	writeChan := make(chan []byte)
-	commChan := make(chan string)
-	conduit := channels.BidirectionalContainerConduit{
-		ReadChan:  readChan,
-		WriteChan: writeChan,
-		CommChan:  commChan,
-		ExecId:    execId,
-	}
+func wrapHijackedResponseIntoConduit(resp types.HijackedResponse, execId string, tty bool) *channels.BidirectionalContainerConduit {
+	// Closing the conduit closes the hijacked connection
+	conduit := channels.NewBidirectionalContainerConduit(execId, resp.Conn)
 	// Run goroutines
-	go listenForHijackedResponseReader(conduit.ReadChan, resp.Reader)
+	go newCommandOutputStreamer(conduit, resp.Reader, tty).Run()
 	// Writer to conn
-	go writeToHijackedResponseConn(conduit.WriteChan, resp.Conn)
-	return &conduit
+	go writeToHijackedResponseConn(conduit, resp.Conn)
+	return conduit
 }
 
 func (dcs DockerContainerService) ExecuteContainerCommand(ctx context.Context, intent commands.ContainerExecuteCommandIntent) (*channels.BidirectionalContainerConduit, error) {
-	execConfig := types.ExecConfig{Tty: intent.UseTty, AttachStdout: true, AttachStderr: true, AttachStdin: intent.Interactive, Cmd: intent.Command}
+	// The command records its pid, so that it can be signalled later on. Images without
+	// a shell run the command as is, it cannot be signalled
+	cmd, pidFile := intent.Command, ""
+	if dcs.hasShell(ctx, intent.ContainerId) {
+		pidFile = pidFilePath(uuid.NewString())
+		cmd = wrapCommandWithPidFile(pidFile, intent.Command)
+	}
+	execConfig := types.ExecConfig{Tty: intent.UseTty, AttachStdout: true, AttachStderr: true, AttachStdin: intent.Interactive, Cmd: cmd}
 	respIdExecCreate, err := dcs.client.ContainerExecCreate(ctx, intent.ContainerId, execConfig)
 	if err != nil {
 		return nil, err
 	}
+	if pidFile != "" {
+		dcs.pidFiles.Store(respIdExecCreate.ID, pidFile)
+	}
 	resp, err := dcs.client.ContainerExecAttach(ctx, respIdExecCreate.ID, types.ExecStartCheck{
 		Tty: intent.UseTty,
 	})
@@ -180,8 +270,132 @@ func (dcs DockerContainerService) ExecuteContainerCommand(ctx context.Context, i
 	if err != nil {
 		return nil, err
 	}
+	// Apply the initial size of the TTY, if known
+	if intent.UseTty && intent.Rows > 0 && intent.Cols > 0 {
+		err = dcs.ResizeCommand(ctx, respIdExecCreate.ID, intent.Rows, intent.Cols)
+		if err != nil {
+			log.Printf("Error while resizing exec %s: %s", respIdExecCreate.ID, err.Error())
+		}
+	}
 	// Create a conduit
-	return wrapHijackedResponseIntoConduit(resp, respIdExecCreate.ID), nil
+	return wrapHijackedResponseIntoConduit(resp, respIdExecCreate.ID, intent.UseTty), nil
+}
+
+// Return whether the command is still running, and its exit code once it has finished
+func (dcs DockerContainerService) InspectCommand(ctx context.Context, execId string) (bool, int, error) {
+	resp, err := dcs.client.ContainerExecInspect(ctx, execId)
+	if err != nil {
+		return false, 0, err
+	}
+	return resp.Running, resp.ExitCode, nil
+}
+
+// Forget the pid file of a command that has finished, however it ended, and remove it
+// from the container. The file is removed in the background, it does not matter if the
+// container is already gone
+func (dcs DockerContainerService) ReleaseCommand(containerId string, execId string) {
+	pidFile, ok := dcs.pidFileFor(execId)
+	if !ok {
+		return
+	}
+	dcs.pidFiles.Delete(execId)
+	go func() {
+		err := dcs.runInContainer(context.Background(), containerId, []string{"rm", "-f", pidFile})
+		if err != nil && !errdefs.IsNotFound(err) && !errdefs.IsConflict(err) {
+			log.Printf("Error while removing pid file of exec %s: %s", execId, err.Error())
+		}
+	}()
+}
+
+// Resize the TTY of a running command
+func (dcs DockerContainerService) ResizeCommand(ctx context.Context, execId string, rows uint, cols uint) error {
+	return dcs.client.ContainerExecResize(ctx, execId, types.ResizeOptions{Height: rows, Width: cols})
+}
+
+// Directory inside containers that holds the pid files of running commands
+const pidFileDir = "/tmp"
+
+// Return the path of the pid file written by a command, inside its container
+func pidFilePath(token string) string {
+	return path.Join(pidFileDir, "unk-"+token+".pid")
+}
+
+// Shell used to record the pid of commands and to signal them
+const containerShell = "/bin/sh"
+
+// Returns true if the container has a shell. Distroless and scratch images do not
+func (dcs DockerContainerService) hasShell(ctx context.Context, containerId string) bool {
+	_, err := dcs.client.ContainerStatPath(ctx, containerId, containerShell)
+	return !errdefs.IsNotFound(err)
+}
+
+// Wrap a command so that it writes its pid into pidFile before it starts. The shell
+// replaces itself with the command, so the pid is the pid of the command as seen inside
+// the container. If the pid file cannot be written, e.g. on a read-only /tmp, the command
+// still runs without a word on its output, it just cannot be signalled
+func wrapCommandWithPidFile(pidFile string, cmd []string) []string {
+	return append([]string{containerShell, "-c", `{ echo $$ > "$0"; } 2>/dev/null; exec "$@"`, pidFile}, cmd...)
+}
+
+// Return the command that sends a signal to the command that wrote pidFile. kill is the
+// shell builtin, so images do not need to ship a kill binary
+func signalCommandFor(pidFile string, signal string) []string {
+	return []string{containerShell, "-c", `kill -s "$1" "$(cat "$0")"`, pidFile, signal}
+}
+
+// Return the pid file of a command started by ExecuteContainerCommand
+func (dcs DockerContainerService) pidFileFor(execId string) (string, bool) {
+	pidFile, ok := dcs.pidFiles.Load(execId)
+	if !ok {
+		return "", false
+	}
+	return pidFile.(string), true
+}
+
+// Run a short lived command inside a container and wait for it to exit. Returns an error
+// with the output of the command if it exits with a non zero code
+func (dcs DockerContainerService) runInContainer(ctx context.Context, containerId string, cmd []string) error {
+	execConfig := types.ExecConfig{AttachStdout: true, AttachStderr: true, Cmd: cmd}
+	respIdExecCreate, err := dcs.client.ContainerExecCreate(ctx, containerId, execConfig)
+	if err != nil {
+		return err
+	}
+	resp, err := dcs.client.ContainerExecAttach(ctx, respIdExecCreate.ID, types.ExecStartCheck{})
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	output := new(bytes.Buffer)
+	if _, err := stdcopy.StdCopy(output, output, resp.Reader); err != nil {
+		return err
+	}
+	inspect, err := dcs.client.ContainerExecInspect(ctx, respIdExecCreate.ID)
+	if err != nil {
+		return err
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("%s exited with code %d: %s", cmd[0], inspect.ExitCode, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// Send a signal to the process of a running command. Docker has no API for signalling
+// execs, and the pid reported by exec inspect is only meaningful on the docker host, so
+// commands record their own pid inside the container and are signalled from inside the
+// container. Signals are named without the SIG prefix, e.g. KILL
+func (dcs DockerContainerService) SignalCommand(ctx context.Context, containerId string, execId string, signal string) error {
+	resp, err := dcs.client.ContainerExecInspect(ctx, execId)
+	if err != nil {
+		return err
+	}
+	if !resp.Running {
+		return nil
+	}
+	pidFile, ok := dcs.pidFileFor(execId)
+	if !ok {
+		return fmt.Errorf("exec %s cannot be signalled, commands can only be signalled in containers with %s", execId, containerShell)
+	}
+	return dcs.runInContainer(ctx, containerId, signalCommandFor(pidFile, signal))
 }
 
 func (dcs DockerContainerService) ReadFile(ctx context.Context, intent commands.SyncFileIntent) ([]byte, error) {
@@ -219,3 +433,90 @@ func (dcs DockerContainerService) ReadFile(ctx context.Context, intent commands.
 	}
 	return contents, nil
 }
+
+// Mode and owner of a file written into a container
+type fileAttributes struct {
+	Mode int64
+	Uid  int
+	Gid  int
+}
+
+// Attributes of files that do not exist yet
+var defaultFileAttributes = fileAttributes{Mode: 0644}
+
+// Build a tar archive holding a single file with given name and contents. The docker
+// copy API only accepts archives, so file writes are wrapped before being sent over
+func archiveFile(name string, contents []byte, attrs fileAttributes) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    attrs.Mode,
+		Uid:     attrs.Uid,
+		Gid:     attrs.Gid,
+		Size:    int64(len(contents)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(contents); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Return the mode and owner of a file inside the container, so that writing the file
+// keeps them. Files that do not exist get the default attributes
+func (dcs DockerContainerService) existingFileAttributes(ctx context.Context, containerId string, filePath string) (fileAttributes, error) {
+	rc, _, err := dcs.client.CopyFromContainer(ctx, containerId, filePath)
+	if errdefs.IsNotFound(err) {
+		return defaultFileAttributes, nil
+	}
+	if err != nil {
+		return fileAttributes{}, err
+	}
+	defer rc.Close()
+	// Only the header is needed, the contents are not read
+	hdr, err := tar.NewReader(rc).Next()
+	if err != nil {
+		return fileAttributes{}, err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return fileAttributes{}, fmt.Errorf("%s is not a regular file", filePath)
+	}
+	return fileAttributes{Mode: hdr.Mode, Uid: hdr.Uid, Gid: hdr.Gid}, nil
+}
+
+// Write the intent contents into the file inside the container, replacing the file
+// if it exists. The mode and owner of an existing file are kept. Returns the number
+// of bytes written
+func (dcs DockerContainerService) WriteFile(ctx context.Context, intent commands.SyncFileIntent) (int, error) {
+	if intent.Content == nil {
+		return 0, errors.New("no content to write")
+	}
+	contents := []byte(*intent.Content)
+	dir, name := path.Split(path.Clean(intent.FilePath))
+	if name == "" || name == "/" || name == "." {
+		return 0, fmt.Errorf("invalid file path %s", intent.FilePath)
+	}
+	if dir == "" {
+		dir = "."
+	}
+	attrs, err := dcs.existingFileAttributes(ctx, intent.ContainerId, intent.FilePath)
+	if err != nil {
+		return 0, err
+	}
+	archive, err := archiveFile(name, contents, attrs)
+	if err != nil {
+		return 0, err
+	}
+	err = dcs.client.CopyToContainer(ctx, intent.ContainerId, dir, archive, types.CopyToContainerOptions{})
+	if err != nil {
+		return 0, err
+	}
+	return len(contents), nil
+}
@@ -0,0 +1,132 @@
+package containerservices
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unklearn/notebook-backend/commands"
+)
+
+func TestArchiveFile(t *testing.T) {
+	buf, err := archiveFile("app.py", []byte("print('hi')"), defaultFileAttributes)
+	assert.Equal(t, err, nil)
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hdr.Name, "app.py")
+	assert.Equal(t, hdr.Size, int64(11))
+	assert.Equal(t, hdr.Mode, int64(0644))
+	contents, _ := ioutil.ReadAll(tr)
+	assert.Equal(t, contents, []byte("print('hi')"))
+
+	// Existing files keep their mode and owner
+	buf, err = archiveFile("run.sh", []byte{}, fileAttributes{Mode: 0755, Uid: 1000, Gid: 100})
+	assert.Equal(t, err, nil)
+	hdr, err = tar.NewReader(buf).Next()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, hdr.Size, int64(0))
+	assert.Equal(t, hdr.Mode, int64(0755))
+	assert.Equal(t, hdr.Uid, 1000)
+	assert.Equal(t, hdr.Gid, 100)
+}
+
+func TestImageReference(t *testing.T) {
+	assert.Equal(t, imageReference("python", "3.6", ""), "python:3.6")
+	assert.Equal(t, imageReference("python", "3.6", "registry.local:5000"), "registry.local:5000/python:3.6")
+	assert.Equal(t, imageReference("team/python", "3.6", "https://registry.local/"), "registry.local/team/python:3.6")
+}
+
+func TestSignalCommandThroughPidFile(t *testing.T) {
+	if _, err := exec.LookPath(containerShell); err != nil {
+		t.Skip("sh is not available")
+	}
+	pidFile := path.Join(t.TempDir(), "unk-exec.pid")
+	wrapped := wrapCommandWithPidFile(pidFile, []string{"sleep", "30"})
+	cmd := exec.Command(wrapped[0], wrapped[1:]...)
+	assert.Nil(t, cmd.Start())
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	// The pid is written before the command starts, it is the pid of the command itself
+	var contents []byte
+	assert.Eventually(t, func() bool {
+		contents, _ = ioutil.ReadFile(pidFile)
+		return len(contents) > 0
+	}, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, strconv.Itoa(cmd.Process.Pid), strings.TrimSpace(string(contents)))
+
+	signal := signalCommandFor(pidFile, "KILL")
+	out, err := exec.Command(signal[0], signal[1:]...).CombinedOutput()
+	assert.Nil(t, err, string(out))
+	select {
+	case err := <-done:
+		assert.Contains(t, err.Error(), "killed")
+	case <-time.After(time.Second * 5):
+		cmd.Process.Kill()
+		t.Fatal("command was not killed")
+	}
+	// Signalling fails if the command never recorded its pid
+	signal = signalCommandFor(path.Join(t.TempDir(), "missing.pid"), "KILL")
+	assert.NotNil(t, exec.Command(signal[0], signal[1:]...).Run())
+}
+
+func TestWrapCommandUnwritablePidFile(t *testing.T) {
+	if _, err := exec.LookPath(containerShell); err != nil {
+		t.Skip("sh is not available")
+	}
+	// The command runs as usual, and nothing is added to its output
+	wrapped := wrapCommandWithPidFile(path.Join(t.TempDir(), "missing", "unk-exec.pid"), []string{"echo", "hi"})
+	out, err := exec.Command(wrapped[0], wrapped[1:]...).CombinedOutput()
+	assert.Nil(t, err)
+	assert.Equal(t, "hi\n", string(out))
+}
+
+func TestPidFileFor(t *testing.T) {
+	dcs := NewDockerContainerService(nil, nil)
+	_, ok := dcs.pidFileFor("exec")
+	assert.False(t, ok)
+	dcs.pidFiles.Store("exec", pidFilePath("token"))
+	pidFile, ok := dcs.pidFileFor("exec")
+	assert.True(t, ok)
+	assert.Equal(t, "/tmp/unk-token.pid", pidFile)
+}
+
+func TestDecodePullProgress(t *testing.T) {
+	stream := `{"status":"Pulling from library/python","id":"3.9"}
+{"status":"Downloading","progressDetail":{"current":512,"total":2048},"id":"a1b2"}
+{"status":"Download complete","id":"a1b2"}
+`
+	progress := []commands.ImagePullProgressResponse{}
+	err := decodePullProgress(strings.NewReader(stream), "python:3.9", "h", func(p commands.ImagePullProgressResponse) {
+		progress = append(progress, p)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []commands.ImagePullProgressResponse{
+		{Image: "python:3.9", Hash: "h", LayerId: "3.9", Status: "Pulling from library/python"},
+		{Image: "python:3.9", Hash: "h", LayerId: "a1b2", Status: "Downloading", Current: 512, Total: 2048},
+		{Image: "python:3.9", Hash: "h", LayerId: "a1b2", Status: "Download complete"},
+	}, progress)
+}
+
+func TestDecodePullProgressError(t *testing.T) {
+	stream := `{"status":"Downloading","progressDetail":{"current":512,"total":2048},"id":"a1b2"}
+{"errorDetail":{"message":"unauthorized: access denied"},"error":"unauthorized: access denied"}
+{"status":"Download complete","id":"a1b2"}
+`
+	progress := []commands.ImagePullProgressResponse{}
+	err := decodePullProgress(strings.NewReader(stream), "private:latest", "h", func(p commands.ImagePullProgressResponse) {
+		progress = append(progress, p)
+	})
+	assert.EqualError(t, err, "unauthorized: access denied")
+	// Progress stops at the failure
+	assert.Len(t, progress, 1)
+
+	err = decodePullProgress(strings.NewReader(`{"status":`), "private:latest", "h", func(p commands.ImagePullProgressResponse) {})
+	assert.NotNil(t, err)
+}
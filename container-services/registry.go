@@ -0,0 +1,86 @@
+package containerservices
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Host under which docker hub credentials are stored
+const DOCKER_HUB_HOST = "docker.io"
+
+// Credentials for a single registry, as stored in the registry config file
+type RegistryCredentials struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Optional token used instead of username and password
+	IdentityToken string `json:"identity_token,omitempty"`
+}
+
+// Server side store of registry credentials keyed by registry host. Credentials are only
+// handed to the docker daemon for image pulls, and must never be sent to the notebook
+type RegistryCredentialStore struct {
+	credentials map[string]RegistryCredentials
+}
+
+func NewRegistryCredentialStore(credentials map[string]RegistryCredentials) *RegistryCredentialStore {
+	return &RegistryCredentialStore{credentials: credentials}
+}
+
+// Load the credential store from a JSON config file of the form
+//
+//  {"registry.example.com": {"username": "user", "password": "secret"}}
+func LoadRegistryCredentialStore(configPath string) (*RegistryCredentialStore, error) {
+	contents, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	credentials := make(map[string]RegistryCredentials)
+	// Do not wrap the decode error, it may quote parts of the file
+	if err := json.Unmarshal(contents, &credentials); err != nil {
+		return nil, fmt.Errorf("invalid registry config file %s", configPath)
+	}
+	return NewRegistryCredentialStore(credentials), nil
+}
+
+// Return the registry host of an image reference. References without a host
+// component resolve to docker hub
+func registryHost(ref string) string {
+	i := strings.IndexRune(ref, '/')
+	if i == -1 {
+		return DOCKER_HUB_HOST
+	}
+	host := ref[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return DOCKER_HUB_HOST
+	}
+	return host
+}
+
+// Return the encoded auth for pulling the given image reference, or an empty string
+// if there are no credentials for its registry
+func (rcs *RegistryCredentialStore) EncodedAuthFor(ref string) (string, error) {
+	if rcs == nil {
+		return "", nil
+	}
+	host := registryHost(ref)
+	creds, ok := rcs.credentials[host]
+	if !ok {
+		return "", nil
+	}
+	authConfig := types.AuthConfig{
+		Username:      creds.Username,
+		Password:      creds.Password,
+		IdentityToken: creds.IdentityToken,
+		ServerAddress: host,
+	}
+	encoded, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
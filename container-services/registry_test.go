@@ -0,0 +1,52 @@
+package containerservices
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryHost(t *testing.T) {
+	assert.Equal(t, registryHost("python:3.6"), DOCKER_HUB_HOST)
+	assert.Equal(t, registryHost("library/python:3.6"), DOCKER_HUB_HOST)
+	assert.Equal(t, registryHost("registry.local:5000/python:3.6"), "registry.local:5000")
+	assert.Equal(t, registryHost("localhost/python:3.6"), "localhost")
+}
+
+func TestLoadRegistryCredentialStore(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "registries.json")
+	ioutil.WriteFile(configPath, []byte(`{"registry.local": {"username": "user", "password": "secret"}}`), 0600)
+	store, err := LoadRegistryCredentialStore(configPath)
+	assert.Equal(t, err, nil)
+
+	auth, err := store.EncodedAuthFor("registry.local/python:3.6")
+	assert.Equal(t, err, nil)
+	decoded, _ := base64.URLEncoding.DecodeString(auth)
+	authConfig := types.AuthConfig{}
+	json.Unmarshal(decoded, &authConfig)
+	assert.Equal(t, authConfig.Username, "user")
+	assert.Equal(t, authConfig.Password, "secret")
+	assert.Equal(t, authConfig.ServerAddress, "registry.local")
+
+	// Unknown registries have no auth
+	auth, _ = store.EncodedAuthFor("python:3.6")
+	assert.Equal(t, auth, "")
+
+	// A nil store has no auth either
+	var empty *RegistryCredentialStore
+	auth, _ = empty.EncodedAuthFor("registry.local/python:3.6")
+	assert.Equal(t, auth, "")
+}
+
+func TestLoadRegistryCredentialStoreInvalid(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "registries.json")
+	ioutil.WriteFile(configPath, []byte(`{"registry.local": "secret"}`), 0600)
+	_, err := LoadRegistryCredentialStore(configPath)
+	assert.NotEqual(t, err, nil)
+	assert.NotContains(t, err.Error(), "secret")
+}
@@ -0,0 +1,97 @@
+package containerservices
+
+import (
+	"io"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/unklearn/notebook-backend/channels"
+)
+
+// Size of the chunks read from the output of a command
+const outputChunkSize = 4096
+
+// Streams the output of a command from the hijacked exec connection onto a conduit.
+// Every chunk is sent in a buffer of its own, since listeners may still hold on to
+// earlier chunks. Read errors other than EOF are recorded on the conduit, and the
+// output channels are closed once the stream ends
+type commandOutputStreamer struct {
+	conduit *channels.BidirectionalContainerConduit
+	reader  io.Reader
+	// Without a TTY, docker multiplexes stdout and stderr into a single stream
+	tty bool
+}
+
+func newCommandOutputStreamer(conduit *channels.BidirectionalContainerConduit, reader io.Reader, tty bool) *commandOutputStreamer {
+	return &commandOutputStreamer{conduit: conduit, reader: reader, tty: tty}
+}
+
+// Stream output until the reader is exhausted or the conduit is closed
+func (cos *commandOutputStreamer) Run() {
+	var err error
+	if cos.tty {
+		// A TTY merges stderr into stdout
+		close(cos.conduit.ErrChan)
+		err = cos.stream()
+		close(cos.conduit.ReadChan)
+	} else {
+		err = cos.demultiplex()
+		close(cos.conduit.ReadChan)
+		close(cos.conduit.ErrChan)
+	}
+	// Errors caused by closing the conduit are expected
+	select {
+	case <-cos.conduit.Done():
+	default:
+		if err != nil {
+			cos.conduit.SetErr(err)
+		}
+	}
+}
+
+// Forward the raw output of a command onto ReadChan
+func (cos *commandOutputStreamer) stream() error {
+	for {
+		// The chunk is handed over to the listener, so it is never reused
+		b := make([]byte, outputChunkSize)
+		n, err := cos.reader.Read(b)
+		if n > 0 {
+			select {
+			case cos.conduit.ReadChan <- b[:n]:
+			case <-cos.conduit.Done():
+				return io.ErrClosedPipe
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Strip stream headers and forward stdout onto ReadChan and stderr onto ErrChan
+func (cos *commandOutputStreamer) demultiplex() error {
+	stdout := chanWriter{ch: cos.conduit.ReadChan, done: cos.conduit.Done()}
+	stderr := chanWriter{ch: cos.conduit.ErrChan, done: cos.conduit.Done()}
+	_, err := stdcopy.StdCopy(stdout, stderr, cos.reader)
+	return err
+}
+
+// Writer that forwards each write onto a channel. Writes are copied before being
+// sent, since callers are free to reuse their buffers once Write returns
+type chanWriter struct {
+	ch   chan []byte
+	done <-chan struct{}
+}
+
+func (cw chanWriter) Write(p []byte) (int, error) {
+	b := make([]byte, len(p))
+	copy(b, p)
+	select {
+	case cw.ch <- b:
+		return len(p), nil
+	case <-cw.done:
+		return 0, io.ErrClosedPipe
+	}
+}
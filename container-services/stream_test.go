@@ -0,0 +1,98 @@
+package containerservices
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+	"github.com/unklearn/notebook-backend/channels"
+)
+
+// A reader that returns each chunk on a separate read, followed by err
+type fakeChunkReader struct {
+	chunks [][]byte
+	err    error
+}
+
+func (f *fakeChunkReader) Read(p []byte) (int, error) {
+	if len(f.chunks) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.chunks[0])
+	f.chunks = f.chunks[1:]
+	return n, nil
+}
+
+// Hijacked exec connections expose their output through a bufio.Reader
+func newFakeHijackedReader(err error, chunks ...string) *bufio.Reader {
+	f := &fakeChunkReader{err: err}
+	for _, c := range chunks {
+		f.chunks = append(f.chunks, []byte(c))
+	}
+	return bufio.NewReaderSize(f, 16)
+}
+
+func TestCommandOutputStreamerOwnsBuffers(t *testing.T) {
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	go newCommandOutputStreamer(conduit, newFakeHijackedReader(io.EOF, "first", "second"), true).Run()
+	first := <-conduit.ReadChan
+	second := <-conduit.ReadChan
+	// Reading the second chunk must not overwrite the first
+	assert.Equal(t, first, []byte("first"))
+	assert.Equal(t, second, []byte("second"))
+	_, ok := <-conduit.ReadChan
+	assert.Equal(t, ok, false)
+	_, ok = <-conduit.ErrChan
+	assert.Equal(t, ok, false)
+	assert.Equal(t, conduit.Err(), nil)
+}
+
+func TestCommandOutputStreamerPropagatesErrors(t *testing.T) {
+	readErr := errors.New("connection reset")
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	go newCommandOutputStreamer(conduit, newFakeHijackedReader(readErr, "partial"), true).Run()
+	assert.Equal(t, <-conduit.ReadChan, []byte("partial"))
+	// The stream ends instead of spinning on the error
+	_, ok := <-conduit.ReadChan
+	assert.Equal(t, ok, false)
+	assert.Equal(t, conduit.Err(), readErr)
+}
+
+func TestCommandOutputStreamerClosedConduit(t *testing.T) {
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	// Nobody reads the output, closing the conduit must still release the streamer
+	conduit.Close()
+	newCommandOutputStreamer(conduit, newFakeHijackedReader(io.EOF, "out"), true).Run()
+	_, ok := <-conduit.ReadChan
+	assert.Equal(t, ok, false)
+	assert.Equal(t, conduit.Err(), nil)
+}
+
+func TestCommandOutputStreamerDemultiplex(t *testing.T) {
+	buf := new(bytes.Buffer)
+	stdcopy.NewStdWriter(buf, stdcopy.Stdout).Write([]byte("out"))
+	stdcopy.NewStdWriter(buf, stdcopy.Stderr).Write([]byte("err"))
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	go newCommandOutputStreamer(conduit, bufio.NewReader(buf), false).Run()
+	assert.Equal(t, <-conduit.ReadChan, []byte("out"))
+	assert.Equal(t, <-conduit.ErrChan, []byte("err"))
+	_, ok := <-conduit.ReadChan
+	assert.Equal(t, ok, false)
+	_, ok = <-conduit.ErrChan
+	assert.Equal(t, ok, false)
+	assert.Equal(t, conduit.Err(), nil)
+}
+
+func TestCommandOutputStreamerDemultiplexClosedConduit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	stdcopy.NewStdWriter(buf, stdcopy.Stdout).Write([]byte("out"))
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	conduit.Close()
+	newCommandOutputStreamer(conduit, bufio.NewReader(buf), false).Run()
+	_, ok := <-conduit.ReadChan
+	assert.Equal(t, ok, false)
+}
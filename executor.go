@@ -3,12 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/docker/docker/errdefs"
 	"github.com/unklearn/notebook-backend/channels"
 	"github.com/unklearn/notebook-backend/commands"
-	"github.com/unklearn/notebook-backend/connection"
+	"github.com/unklearn/notebook-backend/notebooks"
+	"github.com/unklearn/notebook-backend/sessions"
 )
 
 type CommandExecutor struct {
@@ -16,49 +22,165 @@ type CommandExecutor struct {
 	dispatch chan commands.ActionIntent
 	// Container service
 	IContainerCommandService
-	// The multiplexed connection
-	conn *connection.MxedWebsocketConn
+	// The notebook session, output is written to the connections attached to it
+	session *sessions.Session
+	// Notebook service used to record cell outputs
+	notebooks INotebookCellService
+	options   CommandExecutorOptions
+	// Output of finished commands, kept so that it can still be replayed
+	finished *channels.FinishedOutputHistories
+	// Closed when the session is shut down
+	done         chan struct{}
+	shutdownOnce *sync.Once
 }
 
-func NewCommandExecutor(cs IContainerCommandService, conn *connection.MxedWebsocketConn) *CommandExecutor {
+// Options that control how the executor relays and records command output
+type CommandExecutorOptions struct {
+	// Batching and throughput limits applied to the output of each command
+	Output channels.OutputOptions
+	// Max bytes of output recorded into the notebook per cell, the most recent output is kept
+	MaxRecordedOutput int
+	// How long the output of a finished command can still be replayed
+	OutputRetention time.Duration
+}
+
+var DefaultCommandExecutorOptions = CommandExecutorOptions{
+	Output:            channels.DefaultOutputOptions,
+	MaxRecordedOutput: 64 * 1024,
+	OutputRetention:   10 * time.Minute,
+}
+
+func NewCommandExecutor(cs IContainerCommandService, nb INotebookCellService, session *sessions.Session, options CommandExecutorOptions) *CommandExecutor {
 	ce := &CommandExecutor{
 		dispatch:                 make(chan commands.ActionIntent, 1),
 		IContainerCommandService: cs,
-		conn:                     conn,
+		session:                  session,
+		notebooks:                nb,
+		options:                  options,
+		finished:                 channels.NewFinishedOutputHistories(options.OutputRetention),
+		done:                     make(chan struct{}),
+		shutdownOnce:             &sync.Once{},
 	}
 	// Start a go routine that listens and executes ExecuteIntents
+	go ce.ExecuteIntents()
 	return ce
 }
 
+type INotebookCellService interface {
+	RecordCellOutput(notebookId string, cellId string, output notebooks.CellOutput) error
+}
+
 type IContainerCommandService interface {
 	CreateNew(ctx context.Context, intent commands.ContainerCreateCommandIntent) (containerId string, err error)
+	EnsureImage(ctx context.Context, intent commands.ImagePullCommandIntent, progress func(commands.ImagePullProgressResponse)) error
 	GetContainerStatus(ctx context.Context, containerId string) (status string, err error)
+	GetContainerNotebook(ctx context.Context, containerId string) (notebookId string, err error)
 	ExecuteContainerCommand(ctx context.Context, intent commands.ContainerExecuteCommandIntent) (*channels.BidirectionalContainerConduit, error)
+	InspectCommand(ctx context.Context, execId string) (running bool, exitCode int, err error)
+	SignalCommand(ctx context.Context, containerId string, execId string, signal string) error
+	// Release what the container service holds for a command that has finished
+	ReleaseCommand(containerId string, execId string)
+	ResizeCommand(ctx context.Context, execId string, rows uint, cols uint) error
 	ReadFile(ctx context.Context, intent commands.SyncFileIntent) (contents []byte, err error)
+	WriteFile(ctx context.Context, intent commands.SyncFileIntent) (written int, err error)
+	StopContainer(ctx context.Context, containerId string, timeout time.Duration) error
 }
 
 func (ce CommandExecutor) createNewContainerSaga(intent commands.ContainerCreateCommandIntent) {
+	// Reuse the existing container if the notebook already knows about one
+	if intent.ContainerId != "" && ce.syncContainerSaga(intent) {
+		return
+	}
+	conn := ce.session
+	// Pull the image first, so that progress can be shown for images that are missing
+	err := ce.pullImageSaga(commands.ImagePullCommandIntent{RequestEnvelope: intent.RequestEnvelope, ChannelId: intent.ChannelId, Image: intent.Image, Tag: intent.ImageTag, RepoUrl: intent.RepoUrl, Hash: intent.Hash})
+	if err != nil {
+		failed, _ := json.Marshal(commands.ContainerStatusResponse{Hash: intent.Hash, Status: "failed", RequestId: intent.RequestId})
+		conn.WriteMessage(intent.ChannelId, string(channels.ContainerStatusEventName), failed)
+		return
+	}
 	// Business logic is encapsulated in this saga
 	containerId, err := ce.IContainerCommandService.CreateNew(context.Background(), intent)
 	// Let conn know that new channel has been registered
-	failed, _ := json.Marshal(commands.ContainerStatusResponse{Id: containerId, Hash: intent.Hash, Status: "failed"})
-	conn := ce.conn
+	failed, _ := json.Marshal(commands.ContainerStatusResponse{Id: containerId, Hash: intent.Hash, Status: "failed", RequestId: intent.RequestId})
 
 	if err != nil {
 		// Write a message stating that container has failed
 		conn.WriteMessage(intent.ChannelId, string(channels.ContainerStatusEventName), failed)
+		ce.reportError(intent.ChannelId, intent.RequestId, "container-create-failed", err)
 		return
 	}
 	// Create new container channel
 	conn.RegisterChannel(containerId, channels.NewContainerChannel(containerId))
 
 	// Let conn know that new channel has been registered
-	response, _ := json.Marshal(commands.ContainerStatusResponse{Id: containerId, Hash: intent.Hash, Status: "pending"})
+	response, _ := json.Marshal(commands.ContainerStatusResponse{Id: containerId, Hash: intent.Hash, Status: "pending", RequestId: intent.RequestId})
 	// Write a message stating that container has started
 	conn.WriteMessage(intent.ChannelId, string(channels.ContainerStatusEventName), response)
 
 	// Wait for container status
-	go ce.waitForContainerSaga(intent.ChannelId, commands.ContainerWaitCommandIntent{ContainerId: containerId})
+	go ce.waitForContainerSaga(intent.ChannelId, commands.ContainerWaitCommandIntent{RequestEnvelope: intent.RequestEnvelope, ContainerId: containerId})
+}
+
+// Pull the image if it is missing on the docker host, streaming pull progress to the channel
+func (ce CommandExecutor) pullImageSaga(intent commands.ImagePullCommandIntent) error {
+	conn := ce.session
+	err := ce.IContainerCommandService.EnsureImage(context.Background(), intent, func(p commands.ImagePullProgressResponse) {
+		out, _ := json.Marshal(p)
+		conn.WriteMessage(intent.ChannelId, string(channels.ImagePullProgressEventName), out)
+	})
+	if err != nil {
+		log.Printf("Error while pulling image %s:%s: %s", intent.Image, intent.Tag, err.Error())
+		out, _ := json.Marshal(commands.ImagePullProgressResponse{Image: intent.Image, Hash: intent.Hash, Status: "failed", Error: err.Error(), RequestId: intent.RequestId})
+		conn.WriteMessage(intent.ChannelId, string(channels.ImagePullProgressEventName), out)
+		ce.reportError(intent.ChannelId, intent.RequestId, "image-pull-failed", err)
+	}
+	return err
+}
+
+// Attach to an existing container instead of creating a new one. A container channel is
+// registered for it in the session and its current status is reported. Only containers
+// created for the notebook can be attached to. Returns false if the container no longer
+// exists, so that a new one can be created in its place
+func (ce CommandExecutor) syncContainerSaga(intent commands.ContainerCreateCommandIntent) bool {
+	conn := ce.session
+	statusResponse := commands.ContainerStatusResponse{Id: intent.ContainerId, Hash: intent.Hash, RequestId: intent.RequestId}
+	notebookId, err := ce.IContainerCommandService.GetContainerNotebook(context.Background(), intent.ContainerId)
+	if errdefs.IsNotFound(err) {
+		log.Printf("Container %s no longer exists, creating a new one", intent.ContainerId)
+		return false
+	}
+	if err == nil && notebookId != conn.Id {
+		log.Printf("Refusing to attach notebook %s to container %s", conn.Id, intent.ContainerId)
+		statusResponse.Status = "failed"
+		out, _ := json.Marshal(statusResponse)
+		conn.WriteMessage(intent.ChannelId, string(channels.ContainerStatusEventName), out)
+		ce.reportError(intent.ChannelId, intent.RequestId, "container-not-owned", fmt.Errorf("container %s does not belong to the notebook", intent.ContainerId))
+		return true
+	}
+	var status string
+	if err == nil {
+		status, err = ce.IContainerCommandService.GetContainerStatus(context.Background(), intent.ContainerId)
+	}
+	if err != nil {
+		statusResponse.Status = "failed"
+		out, _ := json.Marshal(statusResponse)
+		conn.WriteMessage(intent.ChannelId, string(channels.ContainerStatusEventName), out)
+		ce.reportError(intent.ChannelId, intent.RequestId, "container-status-failed", err)
+		return true
+	}
+	// The channel may already exist if the notebook syncs twice, or has reconnected to its session
+	if _, e := conn.GetChannelById(intent.ContainerId); e != nil {
+		conn.RegisterChannel(intent.ContainerId, channels.NewContainerChannel(intent.ContainerId))
+	}
+	statusResponse.Status = status
+	out, _ := json.Marshal(statusResponse)
+	conn.WriteMessage(intent.ChannelId, string(channels.ContainerStatusEventName), out)
+	// Container is still coming up, keep the notebook posted until it is running
+	if status == "created" || status == "restarting" {
+		go ce.waitForContainerSaga(intent.ChannelId, commands.ContainerWaitCommandIntent{RequestEnvelope: intent.RequestEnvelope, ContainerId: intent.ContainerId})
+	}
+	return true
 }
 
 func (ce CommandExecutor) waitForContainerSaga(channelId string, intent commands.ContainerWaitCommandIntent) {
@@ -67,9 +189,9 @@ func (ce CommandExecutor) waitForContainerSaga(channelId string, intent commands
 	if timeout == 0 {
 		timeout = 15
 	}
-	conn := ce.conn
+	conn := ce.session
 	sleepTime := 3
-	statusResponse := commands.ContainerStatusResponse{Id: intent.ContainerId, Status: "failed"}
+	statusResponse := commands.ContainerStatusResponse{Id: intent.ContainerId, Status: "failed", RequestId: intent.RequestId}
 	for {
 		// Inspect the container
 		status, e := ce.IContainerCommandService.GetContainerStatus(context.Background(), intent.ContainerId)
@@ -77,6 +199,7 @@ func (ce CommandExecutor) waitForContainerSaga(channelId string, intent commands
 			statusResponse.Status = "error"
 			out, _ := json.Marshal(statusResponse)
 			conn.WriteMessage(channelId, string(channels.ContainerStatusEventName), out)
+			ce.reportError(channelId, intent.RequestId, "container-status-failed", e)
 			break
 		}
 		times += 1
@@ -96,76 +219,413 @@ func (ce CommandExecutor) waitForContainerSaga(channelId string, intent commands
 	}
 }
 
+func (ce CommandExecutor) stopContainerSaga(intent commands.ContainerStopCommandIntent) {
+	conn := ce.session
+	statusResponse := commands.ContainerStatusResponse{Id: intent.ContainerId, Hash: intent.Hash, Status: "stopped", RequestId: intent.RequestId}
+	// Commands exit along with the container, they are reported as stopped rather than failed
+	commandChannels := []*channels.ContainerCommandChannel{}
+	for _, ch := range conn.ChannelsByParent(intent.ContainerId) {
+		if cch, ok := ch.(*channels.ContainerCommandChannel); ok {
+			cch.SetStopped(true)
+			commandChannels = append(commandChannels, cch)
+		}
+	}
+	err := ce.IContainerCommandService.StopContainer(context.Background(), intent.ContainerId, time.Second*time.Duration(intent.Timeout))
+	if err != nil {
+		log.Printf("Error while stopping container %s: %s", intent.ContainerId, err.Error())
+		for _, cch := range commandChannels {
+			cch.SetStopped(false)
+		}
+		statusResponse.Status = "failed"
+		out, _ := json.Marshal(statusResponse)
+		conn.WriteMessage(intent.ChannelId, string(channels.ContainerStatusEventName), out)
+		ce.reportError(intent.ChannelId, intent.RequestId, "container-stop-failed", err)
+		return
+	}
+	// Remove command channels running inside the container, followed by the container channel
+	for _, ch := range conn.ChannelsByParent(intent.ContainerId) {
+		if cch, ok := ch.(*channels.ContainerCommandChannel); ok {
+			cch.Close()
+		}
+		conn.DeregisterChannel(ch.GetId())
+	}
+	conn.DeregisterChannel(intent.ContainerId)
+	out, _ := json.Marshal(statusResponse)
+	conn.WriteMessage(intent.ChannelId, string(channels.ContainerStatusEventName), out)
+}
+
 func (ce CommandExecutor) executeContainerCommandSaga(intent commands.ContainerExecuteCommandIntent) {
+	startedAt := time.Now()
 	conduit, err := ce.ExecuteContainerCommand(context.Background(), intent)
-	conn := ce.conn
+	conn := ce.session
 	if err != nil {
-		failed, _ := json.Marshal(commands.ContainerCommandStatusResponse{ExecId: conduit.ExecId, CellId: intent.CellId, Status: "failed", Reason: err.Error()})
+		failed, _ := json.Marshal(commands.ContainerCommandStatusResponse{CellId: intent.CellId, Status: "failed", Reason: err.Error(), RequestId: intent.RequestId})
 		// Write a message stating that container command execution has failed
 		conn.WriteMessage(intent.ContainerId, string(channels.ContainerCommandStatusEventName), failed)
+		ce.reportError(intent.ContainerId, intent.RequestId, "command-exec-failed", err)
 		return
 	}
-	// Create new container command channel
-	ch := channels.NewContainerCommandChannel(intent.CellId, conduit)
-	conn.RegisterChannel(intent.CellId, ch)
+	// Viewers of the notebook see the output, only the connection that ran the command can write to it
+	conduit.ClaimStdin(intent.ConnectionId)
+	// Create new container command channel. If the cell is being re-run, the new exec
+	// takes over the cell, so that input and signals reach the new command
+	ch := channels.NewContainerCommandChannel(intent.CellId, intent.ContainerId, conduit)
+	successResponse := commands.ContainerCommandStatusResponse{ExecId: conduit.ExecId, CellId: intent.CellId, Status: "success", RequestId: intent.RequestId}
+	if previous, ok := conn.ReplaceChannel(intent.CellId, ch).(*channels.ContainerCommandChannel); ok {
+		successResponse.PreviousExecId = previous.GetExecId()
+		if !intent.KeepPrevious {
+			go ce.killReplacedCommand(previous)
+		}
+	}
 	// No wait here, some commands never send output
-	success, _ := json.Marshal(commands.ContainerCommandStatusResponse{ExecId: conduit.ExecId, CellId: intent.CellId, Status: "success"})
+	success, _ := json.Marshal(successResponse)
 	conn.WriteMessage(intent.ContainerId, string(channels.ContainerCommandStatusEventName), success)
-	// Run go-routines to wait on command output, and command input if interactive is true
-	if intent.Interactive {
-		go ce.listenForComandOutput(conduit, intent.ContainerId, intent.CellId)
-	}
+	// Run go-routine to stream command output, input is written by the command channel
+	go ce.listenForComandOutput(conduit, intent, startedAt)
 }
 
-func (ce CommandExecutor) listenForComandOutput(conduit *channels.BidirectionalContainerConduit, containerId string, cellId string) {
+func (ce CommandExecutor) listenForComandOutput(conduit *channels.BidirectionalContainerConduit, intent commands.ContainerExecuteCommandIntent, startedAt time.Time) {
+	containerId := intent.ContainerId
+	cellId := intent.CellId
 	go func() {
+		// A nil deadline never fires, so commands without a timeout run until they exit
+		var deadline <-chan time.Time
+		if intent.Timeout > 0 {
+			timer := time.NewTimer(time.Second*time.Duration(intent.Timeout) - time.Since(startedAt))
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		// Commands with a TTY have a single combined output stream. The streams share the
+		// max throughput of the command
+		limiter := channels.NewThroughputLimiter(ce.options.Output.MaxThroughput)
+		stdout := &commandOutputStream{name: "stdout", eventName: channels.ContainerCommandStdoutEventName, coalescer: channels.NewOutputCoalescerWithLimiter(ce.options.Output, limiter)}
+		if intent.UseTty {
+			stdout.name, stdout.eventName = "output", channels.ContainerCommandOutputEventName
+		}
+		stderr := &commandOutputStream{name: "stderr", eventName: channels.ContainerCommandStderrEventName, coalescer: channels.NewOutputCoalescerWithLimiter(ce.options.Output, limiter)}
+		// Output is sent in batches, at least once per flush interval
+		ticker := time.NewTicker(ce.options.Output.FlushInterval)
+		defer ticker.Stop()
+		// Streams are set to nil once drained, so that they are no longer selected
+		readChan, errChan := conduit.ReadChan, conduit.ErrChan
+		var statusResponse commands.ContainerCommandStatusResponse
 	L:
 		for {
-		S:
 			select {
-			case read := <-conduit.ReadChan:
-				ce.conn.WriteMessage(cellId, string(channels.ContainerCommandOutputEventName), read)
-				break S
-			case cmd := <-conduit.CommChan:
-				// Parse command. If it is a close op, exit the loop and update status
-				// Other ops are pending
-				if cmd == "quit" {
-					stopped, _ := json.Marshal(commands.ContainerCommandStatusResponse{ExecId: conduit.ExecId, CellId: cellId, Status: "stopped"})
-					ce.conn.WriteMessage(containerId, string(channels.ContainerCommandStatusEventName), stopped)
+			case read, ok := <-readChan:
+				if !ok {
+					readChan = nil
+					ce.flushCommandOutput(conduit, intent, stdout)
+				} else if stdout.coalescer.Add(read, time.Now()) {
+					ce.flushCommandOutput(conduit, intent, stdout)
+				}
+			case read, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					ce.flushCommandOutput(conduit, intent, stderr)
+				} else if stderr.coalescer.Add(read, time.Now()) {
+					ce.flushCommandOutput(conduit, intent, stderr)
+				}
+			case <-ticker.C:
+				ce.flushCommandOutput(conduit, intent, stdout)
+				ce.flushCommandOutput(conduit, intent, stderr)
+			case <-deadline:
+				ce.flushCommandOutput(conduit, intent, stdout)
+				ce.flushCommandOutput(conduit, intent, stderr)
+				var killed bool
+				statusResponse, killed = ce.commandTimedOutSaga(conduit, intent, startedAt)
+				if killed {
 					break L
 				}
-				break S
+				// The command is still running, keep relaying its output until it exits
+				deadline = nil
 			}
+			if readChan == nil && errChan == nil {
+				// Output has been drained, the command has exited
+				statusResponse = ce.commandCompletedSaga(conduit, intent, startedAt)
+				break L
+			}
+		}
+		ce.finished.Add(conduit.ExecId, cellId, conduit.History, time.Now())
+		// A cell that has been re-run is recorded by the command that replaced it
+		if ce.releaseCommandChannel(conduit, containerId, cellId) {
+			ce.recordCellOutputSaga(conduit, cellId, startedAt, statusResponse)
 		}
 	}()
 }
 
+// A single output stream of a command, relayed in batches
+type commandOutputStream struct {
+	name      string
+	eventName channels.ContainerCommandChannelEventNames
+	coalescer *channels.OutputCoalescer
+}
+
+// Send the batched output of a stream, and let the notebook know if output was dropped
+// to stay under the max throughput. Batches carry their sequence number, so that the
+// notebook can ask for the output it missed
+func (ce CommandExecutor) flushCommandOutput(conduit *channels.BidirectionalContainerConduit, intent commands.ContainerExecuteCommandIntent, stream *commandOutputStream) {
+	cellId := intent.CellId
+	batch, dropped := stream.coalescer.Take()
+	if len(batch) > 0 {
+		// Keep the batch, so that it can be replayed if the notebook misses it
+		seq := conduit.History.Append(string(stream.eventName), batch)
+		out, _ := json.Marshal(commands.CommandOutputEntry{Seq: seq, EventName: string(stream.eventName), Data: batch})
+		ce.session.WriteMessage(cellId, string(stream.eventName), out)
+	}
+	if dropped > 0 {
+		truncated, _ := json.Marshal(commands.ContainerCommandOutputTruncatedResponse{ExecId: conduit.ExecId, CellId: cellId, Stream: stream.name, DroppedBytes: dropped, RequestId: intent.RequestId})
+		ce.session.WriteMessage(cellId, string(channels.ContainerCommandOutputTruncatedEventName), truncated)
+	}
+}
+
+// Kill the command of a cell that has been re-run. Its listener reports the exit
+// once the output has been drained
+func (ce CommandExecutor) killReplacedCommand(cch *channels.ContainerCommandChannel) {
+	err := ce.IContainerCommandService.SignalCommand(context.Background(), cch.GetContainerId(), cch.GetExecId(), "KILL")
+	if err != nil {
+		log.Printf("Error while killing replaced exec %s: %s", cch.GetExecId(), err.Error())
+	}
+	cch.Close()
+}
+
+// Close the conduit of a finished command and remove its channel from the registry,
+// so that the goroutines, the connection and the container resources serving it are
+// released. Returns false if the cell is now owned by another command
+func (ce CommandExecutor) releaseCommandChannel(conduit *channels.BidirectionalContainerConduit, containerId string, cellId string) bool {
+	conduit.Close()
+	ce.IContainerCommandService.ReleaseCommand(containerId, conduit.ExecId)
+	ch, err := ce.session.GetChannelById(cellId)
+	if err != nil {
+		return true
+	}
+	// The cell may have been re-run, in which case the channel belongs to another exec
+	if cch, ok := ch.(*channels.ContainerCommandChannel); ok {
+		if cch.GetExecId() != conduit.ExecId {
+			return false
+		}
+		ce.session.DeregisterChannel(cellId)
+	}
+	return true
+}
+
+// Kill a command that has overrun its timeout and close its conduit. If the command
+// cannot be killed it is reported as failed and its conduit is left open, since it is
+// still running. Returns true if the command was killed
+func (ce CommandExecutor) commandTimedOutSaga(conduit *channels.BidirectionalContainerConduit, intent commands.ContainerExecuteCommandIntent, startedAt time.Time) (commands.ContainerCommandStatusResponse, bool) {
+	containerId := intent.ContainerId
+	statusResponse := commands.ContainerCommandStatusResponse{ExecId: conduit.ExecId, CellId: intent.CellId, Status: "timed-out", RequestId: intent.RequestId}
+	err := ce.IContainerCommandService.SignalCommand(context.Background(), containerId, conduit.ExecId, "KILL")
+	if err != nil {
+		log.Printf("Error while killing exec %s: %s", conduit.ExecId, err.Error())
+		statusResponse.Status = "failed"
+		statusResponse.Reason = err.Error()
+	} else {
+		conduit.Close()
+	}
+	statusResponse.Duration = time.Since(startedAt).Milliseconds()
+	out, _ := json.Marshal(statusResponse)
+	ce.session.WriteMessage(containerId, string(channels.ContainerCommandStatusEventName), out)
+	if err != nil {
+		ce.reportError(containerId, intent.RequestId, "command-signal-failed", err)
+	}
+	return statusResponse, err == nil
+}
+
+// Deliver a signal to a running command, e.g. to interrupt it
+func (ce CommandExecutor) signalCommandSaga(intent commands.ContainerCommandSignalIntent) {
+	statusResponse := commands.ContainerCommandStatusResponse{ExecId: intent.ExecId, CellId: intent.CellId, Status: "signalled", Reason: intent.Signal, RequestId: intent.RequestId}
+	err := ce.IContainerCommandService.SignalCommand(context.Background(), intent.ContainerId, intent.ExecId, strings.TrimPrefix(intent.Signal, "SIG"))
+	if err != nil {
+		statusResponse.Status = "failed"
+		statusResponse.Reason = err.Error()
+	}
+	out, _ := json.Marshal(statusResponse)
+	ce.session.WriteMessage(intent.ContainerId, string(channels.ContainerCommandStatusEventName), out)
+	if err != nil {
+		ce.reportError(intent.ContainerId, intent.RequestId, "command-signal-failed", err)
+	}
+}
+
+// Resize the TTY of a running command. Resizes are frequent, so only failures are reported
+func (ce CommandExecutor) resizeCommandSaga(intent commands.ContainerCommandResizeIntent) {
+	err := ce.IContainerCommandService.ResizeCommand(context.Background(), intent.ExecId, intent.Rows, intent.Cols)
+	if err != nil {
+		failed, _ := json.Marshal(commands.ContainerCommandStatusResponse{ExecId: intent.ExecId, CellId: intent.CellId, Status: "failed", Reason: err.Error(), RequestId: intent.RequestId})
+		ce.session.WriteMessage(intent.ContainerId, string(channels.ContainerCommandStatusEventName), failed)
+		ce.reportError(intent.ContainerId, intent.RequestId, "command-resize-failed", err)
+	}
+}
+
+// Send the output a command sent after the requested sequence number. The output of a
+// finished command can be replayed for the output retention window
+func (ce CommandExecutor) replayCommandOutputSaga(intent commands.ContainerCommandReplayIntent) {
+	replayResponse := commands.ContainerCommandReplayResponse{ExecId: intent.ExecId, CellId: intent.CellId, Entries: []commands.CommandOutputEntry{}, RequestId: intent.RequestId}
+	history, ok := ce.finished.Get(intent.ExecId, intent.CellId, time.Now())
+	if ch, err := ce.session.GetChannelById(intent.CellId); err == nil {
+		if cch, running := ch.(*channels.ContainerCommandChannel); running && cch.GetExecId() == intent.ExecId {
+			history, ok = cch.GetHistory(), true
+		}
+	}
+	if !ok {
+		replayResponse.Error = "output is no longer available"
+	} else {
+		entries, complete := history.Since(intent.Since)
+		replayResponse.Entries = entries
+		replayResponse.Truncated = !complete
+	}
+	out, _ := json.Marshal(replayResponse)
+	ce.session.WriteMessage(intent.CellId, string(channels.ContainerCommandReplayEventName), out)
+	if replayResponse.Error != "" {
+		ce.reportError(intent.CellId, intent.RequestId, "output-unavailable", errors.New(replayResponse.Error))
+	}
+}
+
+// Report the exit code and duration of a command whose output has ended
+func (ce CommandExecutor) commandCompletedSaga(conduit *channels.BidirectionalContainerConduit, intent commands.ContainerExecuteCommandIntent, startedAt time.Time) commands.ContainerCommandStatusResponse {
+	containerId := intent.ContainerId
+	statusResponse := commands.ContainerCommandStatusResponse{ExecId: conduit.ExecId, CellId: intent.CellId, Status: "completed", RequestId: intent.RequestId}
+	// Output can also end because the container was stopped, or the connection to the command broke
+	if conduit.Stopped() {
+		statusResponse.Status = "stopped"
+	} else if err := conduit.Err(); err != nil {
+		statusResponse.Status = "error"
+		statusResponse.Reason = err.Error()
+	}
+	// The exec can be reported as running for a short while after its output has closed
+	for attempt := 0; attempt < 10 && statusResponse.Status == "completed"; attempt++ {
+		running, exitCode, err := ce.IContainerCommandService.InspectCommand(context.Background(), conduit.ExecId)
+		if err != nil {
+			statusResponse.Status = "error"
+			statusResponse.Reason = err.Error()
+			break
+		}
+		if !running {
+			statusResponse.ExitCode = &exitCode
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if statusResponse.Status == "completed" && statusResponse.ExitCode == nil {
+		statusResponse.Reason = "exit code is not available yet"
+	}
+	statusResponse.Duration = time.Since(startedAt).Milliseconds()
+	out, _ := json.Marshal(statusResponse)
+	ce.session.WriteMessage(containerId, string(channels.ContainerCommandStatusEventName), out)
+	if statusResponse.Status == "error" {
+		ce.reportError(containerId, intent.RequestId, "command-failed", errors.New(statusResponse.Reason))
+	}
+	return statusResponse
+}
+
+// Record the output and final status of a finished command into its notebook cell,
+// so that reopening the notebook shows the result of the last run
+func (ce CommandExecutor) recordCellOutputSaga(conduit *channels.BidirectionalContainerConduit, cellId string, startedAt time.Time, statusResponse commands.ContainerCommandStatusResponse) {
+	if ce.notebooks == nil {
+		return
+	}
+	outputs, truncated := recordedCellOutputs(conduit.History, ce.options.MaxRecordedOutput)
+	output := notebooks.CellOutput{
+		ExecId:     conduit.ExecId,
+		Status:     statusResponse.Status,
+		ExitCode:   statusResponse.ExitCode,
+		StartedAt:  startedAt.UTC(),
+		FinishedAt: time.Now().UTC(),
+		Outputs:    outputs,
+		Truncated:  truncated,
+	}
+	if err := ce.notebooks.RecordCellOutput(ce.session.Id, cellId, output); err != nil {
+		log.Printf("Error while recording output of cell %s: %s", cellId, err.Error())
+	}
+}
+
+// Build the outputs recorded for a cell from the output history of its command, keeping
+// at most maxBytes of the most recent output. Consecutive output of the same stream is merged
+func recordedCellOutputs(history *channels.OutputHistory, maxBytes int) ([]notebooks.CellStreamOutput, bool) {
+	entries, complete := history.Since(0)
+	truncated := !complete
+	// Walk back from the most recent output until the budget is spent
+	first, size := len(entries), 0
+	for first > 0 && size+len(entries[first-1].Data) <= maxBytes {
+		first -= 1
+		size += len(entries[first].Data)
+	}
+	if first > 0 {
+		truncated = true
+		// Keep the tail of the batch that does not fit as a whole
+		if remaining := maxBytes - size; remaining > 0 {
+			first -= 1
+			data := entries[first].Data
+			entries[first].Data = data[len(data)-remaining:]
+		}
+	}
+	outputs := []notebooks.CellStreamOutput{}
+	for _, entry := range entries[first:] {
+		name := strings.TrimPrefix(entry.EventName, "command/")
+		if n := len(outputs); n > 0 && outputs[n-1].Name == name {
+			outputs[n-1].Text += string(entry.Data)
+			continue
+		}
+		outputs = append(outputs, notebooks.CellStreamOutput{Name: name, Text: string(entry.Data)})
+	}
+	return outputs, truncated
+}
+
 func (ce CommandExecutor) syncFileSaga(intent commands.SyncFileIntent) {
-	if len(intent.Content) == 0 {
+	fileResponse := commands.SyncFileResponse{NotebookId: ce.session.Id, FilePath: intent.FilePath, CellId: intent.CellId, Error: "", Content: "", RequestId: intent.RequestId}
+	if intent.Content == nil {
 		// Read file contents using cat and write to underlying container channel
 		output, err := ce.ReadFile(context.Background(), intent)
-		fileResponse := commands.SyncFileResponse{NotebookId: ce.conn.Id, FilePath: intent.FilePath, CellId: intent.CellId, Error: "", Content: ""}
 		if err != nil {
 			fileResponse.Error = err.Error()
 		} else {
 			fileResponse.Content = string(output)
 		}
-		resp, _ := json.Marshal(fileResponse)
-		ce.conn.WriteMessage(intent.ContainerId, string(channels.ContainerSyncFileOutputEventName), resp)
 	} else {
-		panic("cannot write to file yet")
+		// Persist the contents into the container and acknowledge with the written size
+		written, err := ce.WriteFile(context.Background(), intent)
+		if err != nil {
+			fileResponse.Error = err.Error()
+		}
+		fileResponse.Size = written
 	}
+	resp, _ := json.Marshal(fileResponse)
+	ce.session.WriteMessage(intent.ContainerId, string(channels.ContainerSyncFileOutputEventName), resp)
+	if fileResponse.Error != "" {
+		ce.reportError(intent.ContainerId, intent.RequestId, "file-sync-failed", errors.New(fileResponse.Error))
+	}
+}
+
+// Report an error on the error event of a channel. Status and output events still carry
+// the outcome, the error event tells the notebook why it failed
+func (ce CommandExecutor) reportError(channelId string, requestId string, code string, err error) {
+	out, _ := json.Marshal(commands.ToErrorResponse(err, code).For(channelId, requestId))
+	ce.session.WriteMessage(channelId, channels.ErrorEventName, out)
 }
 
 // Executor channel <- receive intent and run it
 
 func (ce CommandExecutor) ExecuteIntents() {
 	// Create a container channel and register it
-	for intent := range ce.dispatch {
+	for {
+		var intent commands.ActionIntent
+		select {
+		case intent = <-ce.dispatch:
+		case <-ce.done:
+			return
+		}
 		log.Printf("Handling intent %s\n", intent.ToString())
 		switch i := intent.(type) {
 		case commands.ContainerCreateCommandIntent:
-			ce.createNewContainerSaga(i)
+			// Image pulls can take a while, do not hold up other intents
+			go ce.createNewContainerSaga(i)
+			continue
+		case commands.ImagePullCommandIntent:
+			go ce.pullImageSaga(i)
+			continue
+		case commands.ContainerStopCommandIntent:
+			// Containers are given a grace period to exit, do not hold up other intents
+			go ce.stopContainerSaga(i)
 			continue
 		// case commands.ContainerWaitCommandIntent:
 		// 	ce.waitForContainerSaga(i)
@@ -173,6 +633,15 @@ func (ce CommandExecutor) ExecuteIntents() {
 		case commands.ContainerExecuteCommandIntent:
 			ce.executeContainerCommandSaga(i)
 			continue
+		case commands.ContainerCommandSignalIntent:
+			ce.signalCommandSaga(i)
+			continue
+		case commands.ContainerCommandResizeIntent:
+			ce.resizeCommandSaga(i)
+			continue
+		case commands.ContainerCommandReplayIntent:
+			ce.replayCommandOutputSaga(i)
+			continue
 		case commands.SyncFileIntent:
 			ce.syncFileSaga(i)
 			continue
@@ -185,31 +654,30 @@ func (ce CommandExecutor) ExecuteIntents() {
 
 func (ce CommandExecutor) DispatchIntents(intents []commands.ActionIntent) {
 	for _, intent := range intents {
-		ce.dispatch <- intent
+		select {
+		case ce.dispatch <- intent:
+		case <-ce.done:
+			log.Printf("Session %s has been shut down, dropping intent %s\n", ce.session.Id, intent.GetIntentName())
+		}
 	}
 }
 
-func (ce CommandExecutor) ConnectionHandler() {
-	mx := ce.conn
-	go ce.ExecuteIntents()
-	for {
-		d, err := mx.ReadMessage()
-		if err != nil {
-			log.Println("Error while reading from connection:", err)
-			break
-		}
-		ch, e := mx.GetChannelById(d.ChannelId)
-		if e != nil {
-			// Respond with bad error-code
-			log.Printf("Error while retrieving channel %s", d.ChannelId)
-			continue
-		}
-		intents, e := ch.HandleMessage(d.EventName, d.Payload)
-		if e != nil {
-			// Write the error to the end user
-			mx.WriteMessage(d.ChannelId, d.EventName, []byte(e.Error()))
+// Stop dispatching intents and stop the containers of the session, along with the
+// commands running inside them
+func (ce CommandExecutor) Shutdown() {
+	ce.shutdownOnce.Do(func() {
+		close(ce.done)
+	})
+	// Containers are stopped side by side, so that shutdown takes a single grace period
+	var wg sync.WaitGroup
+	for _, ch := range ce.session.ListChannels() {
+		if _, ok := ch.(*channels.ContainerChannel); ok {
+			wg.Add(1)
+			go func(containerId string) {
+				defer wg.Done()
+				ce.stopContainerSaga(commands.ContainerStopCommandIntent{ChannelId: ce.session.Id, ContainerId: containerId, Timeout: 10})
+			}(ch.GetId())
 		}
-		// Dispatch intents
-		ce.DispatchIntents(intents)
 	}
+	wg.Wait()
 }
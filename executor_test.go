@@ -0,0 +1,755 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/unklearn/notebook-backend/channels"
+	"github.com/unklearn/notebook-backend/commands"
+	"github.com/unklearn/notebook-backend/connection"
+	"github.com/unklearn/notebook-backend/notebooks"
+	"github.com/unklearn/notebook-backend/sessions"
+)
+
+// Result of a single InspectCommand call
+type inspectResult struct {
+	running  bool
+	exitCode int
+	err      error
+}
+
+// A container service that answers from canned results. Methods that a test does not
+// set up panic through the nil embedded interface
+type fakeContainerService struct {
+	IContainerCommandService
+	mu sync.Mutex
+	// Results returned by InspectCommand in order, the last one is repeated
+	inspects  []inspectResult
+	inspected int
+	signalErr error
+	signalled []string
+	// Exec ids released once their command finished
+	released []string
+	stopErr  error
+	stopped  []string
+	// Called by StopContainer before it returns, e.g. to hold up the stop
+	stopHook func()
+	// Existing containers by id, other containers are not found
+	containers map[string]fakeContainer
+	// Contents of files by path
+	files map[string]string
+	// Commands handed out by ExecuteContainerCommand in order
+	commands []*fakeCommand
+	// Progress reported by EnsureImage before it fails with pullErr
+	pullProgress []commands.ImagePullProgressResponse
+	pullErr      error
+}
+
+func (f *fakeContainerService) EnsureImage(ctx context.Context, intent commands.ImagePullCommandIntent, progress func(commands.ImagePullProgressResponse)) error {
+	for _, p := range f.pullProgress {
+		progress(p)
+	}
+	return f.pullErr
+}
+
+// A command run by the fake container service. Its output ends once it exits, or once
+// its conduit is closed, like the output of a killed exec
+type fakeCommand struct {
+	conduit *channels.BidirectionalContainerConduit
+	exit    chan struct{}
+}
+
+func newFakeCommand(execId string) *fakeCommand {
+	c := &fakeCommand{conduit: channels.NewBidirectionalContainerConduit(execId, nil), exit: make(chan struct{})}
+	go func() {
+		select {
+		case <-c.exit:
+		case <-c.conduit.Done():
+		}
+		close(c.conduit.ReadChan)
+		close(c.conduit.ErrChan)
+	}()
+	return c
+}
+
+func (f *fakeContainerService) ExecuteContainerCommand(ctx context.Context, intent commands.ContainerExecuteCommandIntent) (*channels.BidirectionalContainerConduit, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.commands) == 0 {
+		return nil, errors.New("no such command")
+	}
+	c := f.commands[0]
+	f.commands = f.commands[1:]
+	return c.conduit, nil
+}
+
+// Returns true if the command of an exec has been released
+func (f *fakeContainerService) isReleased(execId string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, released := range f.released {
+		if released == execId {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the signals sent so far
+func (f *fakeContainerService) signals() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.signalled...)
+}
+
+// A notebook service that records cell outputs
+type fakeNotebookService struct {
+	mu       sync.Mutex
+	recorded map[string][]notebooks.CellOutput
+}
+
+func (f *fakeNotebookService) RecordCellOutput(notebookId string, cellId string, output notebooks.CellOutput) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recorded[cellId] = append(f.recorded[cellId], output)
+	return nil
+}
+
+// Return the outputs recorded for a cell
+func (f *fakeNotebookService) outputs(cellId string) []notebooks.CellOutput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]notebooks.CellOutput{}, f.recorded[cellId]...)
+}
+
+type fakeContainer struct {
+	notebookId string
+	status     string
+}
+
+func (f *fakeContainerService) container(containerId string) (fakeContainer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[containerId]
+	if !ok {
+		return c, errdefs.NotFound(errors.New("no such container"))
+	}
+	return c, nil
+}
+
+func (f *fakeContainerService) GetContainerNotebook(ctx context.Context, containerId string) (string, error) {
+	c, err := f.container(containerId)
+	return c.notebookId, err
+}
+
+func (f *fakeContainerService) GetContainerStatus(ctx context.Context, containerId string) (string, error) {
+	c, err := f.container(containerId)
+	return c.status, err
+}
+
+func (f *fakeContainerService) InspectCommand(ctx context.Context, execId string) (bool, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := f.inspects[len(f.inspects)-1]
+	if f.inspected < len(f.inspects) {
+		r = f.inspects[f.inspected]
+	}
+	f.inspected += 1
+	return r.running, r.exitCode, r.err
+}
+
+func (f *fakeContainerService) SignalCommand(ctx context.Context, containerId string, execId string, signal string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.signalled = append(f.signalled, signal)
+	return f.signalErr
+}
+
+func (f *fakeContainerService) ReleaseCommand(containerId string, execId string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.released = append(f.released, execId)
+}
+
+func (f *fakeContainerService) StopContainer(ctx context.Context, containerId string, timeout time.Duration) error {
+	f.mu.Lock()
+	f.stopped = append(f.stopped, containerId)
+	hook := f.stopHook
+	f.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+	return f.stopErr
+}
+
+func (f *fakeContainerService) ReadFile(ctx context.Context, intent commands.SyncFileIntent) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return []byte(f.files[intent.FilePath]), nil
+}
+
+func (f *fakeContainerService) WriteFile(ctx context.Context, intent commands.SyncFileIntent) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[intent.FilePath] = *intent.Content
+	return len(*intent.Content), nil
+}
+
+// A websocket conn that records written messages
+type recordingWebsocketConn struct {
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func (r *recordingWebsocketConn) WriteMessage(messageType int, payload []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.written = append(r.written, payload)
+	return nil
+}
+
+func (r *recordingWebsocketConn) ReadMessage() (int, []byte, error) {
+	return 0, nil, nil
+}
+
+func (r *recordingWebsocketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (r *recordingWebsocketConn) Close() error {
+	return nil
+}
+
+// An executor for the session of notebook nb, with a single connection attached
+type testExecutor struct {
+	*CommandExecutor
+	ws    *recordingWebsocketConn
+	mx    *connection.MxedWebsocketConn
+	cells *fakeNotebookService
+}
+
+func newTestExecutor(cs IContainerCommandService) *testExecutor {
+	te := &testExecutor{ws: &recordingWebsocketConn{}, cells: &fakeNotebookService{recorded: map[string][]notebooks.CellOutput{}}}
+	m := sessions.NewManager(func(s *sessions.Session) sessions.ISessionExecutor {
+		te.CommandExecutor = NewCommandExecutor(cs, te.cells, s, DefaultCommandExecutorOptions)
+		return te.CommandExecutor
+	}, time.Minute)
+	te.mx = connection.NewMxedWebsocketConn(te.ws, "conn")
+	m.Attach("nb", te.mx)
+	return te
+}
+
+// Close the connection and return the messages written to it, decoded
+func (te *testExecutor) messages(t *testing.T) []connection.DecodedMxWebsocketResponse {
+	te.mx.Close()
+	te.ws.mu.Lock()
+	defer te.ws.mu.Unlock()
+	decoded := []connection.DecodedMxWebsocketResponse{}
+	for _, message := range te.ws.written {
+		d, err := connection.NewMxedWebsocketSubprotocol().Decode(message)
+		assert.Nil(t, err)
+		decoded = append(decoded, d)
+	}
+	return decoded
+}
+
+// Return the command statuses and error codes written to the connection
+func commandEvents(t *testing.T, messages []connection.DecodedMxWebsocketResponse) ([]commands.ContainerCommandStatusResponse, []string) {
+	statuses, codes := []commands.ContainerCommandStatusResponse{}, []string{}
+	for _, m := range messages {
+		switch m.EventName {
+		case string(channels.ContainerCommandStatusEventName):
+			var status commands.ContainerCommandStatusResponse
+			assert.Nil(t, json.Unmarshal(m.Payload, &status))
+			statuses = append(statuses, status)
+		case channels.ErrorEventName:
+			var e commands.ErrorResponse
+			assert.Nil(t, json.Unmarshal(m.Payload, &e))
+			codes = append(codes, e.Code)
+		}
+	}
+	return statuses, codes
+}
+
+// Return the container statuses and error codes written to the connection
+func containerEvents(t *testing.T, messages []connection.DecodedMxWebsocketResponse) ([]commands.ContainerStatusResponse, []string) {
+	statuses, codes := []commands.ContainerStatusResponse{}, []string{}
+	for _, m := range messages {
+		switch m.EventName {
+		case string(channels.ContainerStatusEventName):
+			var status commands.ContainerStatusResponse
+			assert.Nil(t, json.Unmarshal(m.Payload, &status))
+			statuses = append(statuses, status)
+		case channels.ErrorEventName:
+			var e commands.ErrorResponse
+			assert.Nil(t, json.Unmarshal(m.Payload, &e))
+			codes = append(codes, e.Code)
+		}
+	}
+	return statuses, codes
+}
+
+// Returns true if the conduit has been closed
+func conduitClosed(conduit *channels.BidirectionalContainerConduit) bool {
+	select {
+	case <-conduit.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+var testExecuteIntent = commands.ContainerExecuteCommandIntent{ContainerId: "container", CellId: "cell", Command: []string{"sleep", "60"}, RequestEnvelope: commands.RequestEnvelope{RequestId: "req"}}
+
+func TestCommandTimedOutSaga(t *testing.T) {
+	cs := &fakeContainerService{}
+	te := newTestExecutor(cs)
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	status, killed := te.commandTimedOutSaga(conduit, testExecuteIntent, time.Now())
+	assert.True(t, killed)
+	assert.Equal(t, "timed-out", status.Status)
+	assert.Equal(t, []string{"KILL"}, cs.signalled)
+	assert.True(t, conduitClosed(conduit))
+	statuses, codes := commandEvents(t, te.messages(t))
+	assert.Equal(t, []commands.ContainerCommandStatusResponse{status}, statuses)
+	assert.Empty(t, codes)
+}
+
+func TestCommandTimedOutSagaKillFails(t *testing.T) {
+	cs := &fakeContainerService{signalErr: errors.New("no such process")}
+	te := newTestExecutor(cs)
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	status, killed := te.commandTimedOutSaga(conduit, testExecuteIntent, time.Now())
+	// The command may still be running, so its output keeps being relayed
+	assert.False(t, killed)
+	assert.Equal(t, "failed", status.Status)
+	assert.Equal(t, "no such process", status.Reason)
+	assert.False(t, conduitClosed(conduit))
+	statuses, codes := commandEvents(t, te.messages(t))
+	assert.Equal(t, []commands.ContainerCommandStatusResponse{status}, statuses)
+	assert.Equal(t, []string{"command-signal-failed"}, codes)
+}
+
+func TestCommandCompletedSaga(t *testing.T) {
+	exitCode := 3
+	cases := []struct {
+		name     string
+		inspects []inspectResult
+		// Breaks the output streams of the command
+		err       error
+		stopped   bool
+		status    string
+		exitCode  *int
+		reason    string
+		inspected int
+		codes     []string
+	}{
+		{name: "exited", inspects: []inspectResult{{exitCode: 3}}, status: "completed", exitCode: &exitCode, inspected: 1, codes: []string{}},
+		{name: "exits while polling", inspects: []inspectResult{{running: true}, {running: true}, {exitCode: 3}}, status: "completed", exitCode: &exitCode, inspected: 3, codes: []string{}},
+		{name: "still running", inspects: []inspectResult{{running: true}}, status: "completed", reason: "exit code is not available yet", inspected: 10, codes: []string{}},
+		{name: "inspect fails", inspects: []inspectResult{{err: errors.New("no such exec")}}, status: "error", reason: "no such exec", inspected: 1, codes: []string{"command-failed"}},
+		{name: "stream broke", err: errors.New("connection reset"), status: "error", reason: "connection reset", codes: []string{"command-failed"}},
+		{name: "container stopped", inspects: []inspectResult{{err: errors.New("no such container")}}, err: errors.New("connection reset"), stopped: true, status: "stopped", codes: []string{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := &fakeContainerService{inspects: c.inspects}
+			te := newTestExecutor(cs)
+			conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+			if c.err != nil {
+				conduit.SetErr(c.err)
+			}
+			conduit.SetStopped(c.stopped)
+			status := te.commandCompletedSaga(conduit, testExecuteIntent, time.Now())
+			assert.Equal(t, c.status, status.Status)
+			assert.Equal(t, c.exitCode, status.ExitCode)
+			assert.Equal(t, c.reason, status.Reason)
+			assert.Equal(t, "exec", status.ExecId)
+			assert.Equal(t, "req", status.RequestId)
+			assert.Equal(t, c.inspected, cs.inspected)
+			statuses, codes := commandEvents(t, te.messages(t))
+			assert.Equal(t, []commands.ContainerCommandStatusResponse{status}, statuses)
+			assert.Equal(t, c.codes, codes)
+		})
+	}
+}
+
+func TestStopContainerSagaStopsCommands(t *testing.T) {
+	cs := &fakeContainerService{}
+	te := newTestExecutor(cs)
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	te.session.RegisterChannel("container", channels.NewContainerChannel("container"))
+	te.session.RegisterChannel("cell", channels.NewContainerCommandChannel("cell", "container", conduit))
+	te.stopContainerSaga(commands.ContainerStopCommandIntent{ChannelId: "nb", ContainerId: "container", Timeout: 10})
+	assert.Equal(t, []string{"container"}, cs.stopped)
+	// The command is closed, and reports stopped once its output has drained
+	assert.True(t, conduit.Stopped())
+	assert.True(t, conduitClosed(conduit))
+	_, err := te.session.GetChannelById("cell")
+	assert.NotNil(t, err)
+	_, err = te.session.GetChannelById("container")
+	assert.NotNil(t, err)
+
+	// Commands keep running if the container could not be stopped
+	cs = &fakeContainerService{stopErr: errors.New("daemon unavailable")}
+	te = newTestExecutor(cs)
+	conduit = channels.NewBidirectionalContainerConduit("exec", nil)
+	te.session.RegisterChannel("container", channels.NewContainerChannel("container"))
+	te.session.RegisterChannel("cell", channels.NewContainerCommandChannel("cell", "container", conduit))
+	te.stopContainerSaga(commands.ContainerStopCommandIntent{ChannelId: "nb", ContainerId: "container", Timeout: 10})
+	assert.False(t, conduit.Stopped())
+	assert.False(t, conduitClosed(conduit))
+}
+
+func TestStopContainerDoesNotBlockIntents(t *testing.T) {
+	release := make(chan struct{})
+	cs := &fakeContainerService{stopHook: func() { <-release }}
+	te := newTestExecutor(cs)
+	defer close(release)
+	te.DispatchIntents([]commands.ActionIntent{
+		commands.ContainerStopCommandIntent{ChannelId: "nb", ContainerId: "container", Timeout: 10},
+		commands.ContainerCommandSignalIntent{ContainerId: "container", CellId: "cell", ExecId: "exec", Signal: "SIGINT"},
+	})
+	// The signal is handled while the container is still stopping
+	assert.Eventually(t, func() bool {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		return len(cs.signalled) == 1
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestShutdownStopsContainersConcurrently(t *testing.T) {
+	// Every stop waits for the others to start, which only completes if they run side by side
+	var started sync.WaitGroup
+	started.Add(2)
+	cs := &fakeContainerService{stopHook: func() {
+		started.Done()
+		started.Wait()
+	}}
+	te := newTestExecutor(cs)
+	te.session.RegisterChannel("first", channels.NewContainerChannel("first"))
+	te.session.RegisterChannel("second", channels.NewContainerChannel("second"))
+	done := make(chan struct{})
+	go func() {
+		te.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("containers were stopped one after another")
+	}
+	assert.ElementsMatch(t, []string{"first", "second"}, cs.stopped)
+}
+
+var testSyncIntent = commands.ContainerCreateCommandIntent{ChannelId: "nb", ContainerId: "container", Hash: "h", RequestEnvelope: commands.RequestEnvelope{RequestId: "req"}}
+
+func TestSyncContainerSagaAttaches(t *testing.T) {
+	cs := &fakeContainerService{containers: map[string]fakeContainer{"container": {notebookId: "nb", status: "running"}}}
+	te := newTestExecutor(cs)
+	assert.True(t, te.syncContainerSaga(testSyncIntent))
+	ch, err := te.session.GetChannelById("container")
+	assert.Nil(t, err)
+	assert.IsType(t, &channels.ContainerChannel{}, ch)
+	// Syncing again keeps the registered channel and reports the status again
+	assert.True(t, te.syncContainerSaga(testSyncIntent))
+	again, _ := te.session.GetChannelById("container")
+	assert.Same(t, ch, again)
+	statuses, codes := containerEvents(t, te.messages(t))
+	running := commands.ContainerStatusResponse{Id: "container", Hash: "h", Status: "running", RequestId: "req"}
+	assert.Equal(t, []commands.ContainerStatusResponse{running, running}, statuses)
+	assert.Empty(t, codes)
+}
+
+func TestSyncContainerSagaNotFound(t *testing.T) {
+	te := newTestExecutor(&fakeContainerService{})
+	// A container that no longer exists is replaced by a new one
+	assert.False(t, te.syncContainerSaga(testSyncIntent))
+	_, err := te.session.GetChannelById("container")
+	assert.NotNil(t, err)
+	statuses, codes := containerEvents(t, te.messages(t))
+	assert.Empty(t, statuses)
+	assert.Empty(t, codes)
+}
+
+func TestSyncContainerSagaRefusesOtherContainers(t *testing.T) {
+	for _, notebookId := range []string{"other", ""} {
+		cs := &fakeContainerService{containers: map[string]fakeContainer{"container": {notebookId: notebookId, status: "running"}}}
+		te := newTestExecutor(cs)
+		assert.True(t, te.syncContainerSaga(testSyncIntent))
+		_, err := te.session.GetChannelById("container")
+		assert.NotNil(t, err)
+		statuses, codes := containerEvents(t, te.messages(t))
+		assert.Equal(t, []commands.ContainerStatusResponse{{Id: "container", Hash: "h", Status: "failed", RequestId: "req"}}, statuses)
+		assert.Equal(t, []string{"container-not-owned"}, codes)
+	}
+}
+
+func TestSyncFileSaga(t *testing.T) {
+	cs := &fakeContainerService{files: map[string]string{"/app.py": "print('hi')"}}
+	te := newTestExecutor(cs)
+	te.syncFileSaga(commands.SyncFileIntent{ContainerId: "container", CellId: "cell", FilePath: "/app.py"})
+	// Saving an emptied file truncates it
+	empty := ""
+	te.syncFileSaga(commands.SyncFileIntent{ContainerId: "container", CellId: "cell", FilePath: "/app.py", Content: &empty})
+	assert.Equal(t, "", cs.files["/app.py"])
+	responses := []commands.SyncFileResponse{}
+	for _, m := range te.messages(t) {
+		assert.Equal(t, string(channels.ContainerSyncFileOutputEventName), m.EventName)
+		var r commands.SyncFileResponse
+		assert.Nil(t, json.Unmarshal(m.Payload, &r))
+		responses = append(responses, r)
+	}
+	assert.Len(t, responses, 2)
+	assert.Equal(t, "print('hi')", responses[0].Content)
+	assert.Equal(t, "", responses[1].Content)
+	assert.Equal(t, 0, responses[1].Size)
+	assert.Equal(t, "", responses[1].Error)
+}
+
+func TestFlushCommandOutputSendsSeq(t *testing.T) {
+	te := newTestExecutor(&fakeContainerService{})
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	stream := &commandOutputStream{name: "stdout", eventName: channels.ContainerCommandStdoutEventName, coalescer: channels.NewOutputCoalescer(channels.DefaultOutputOptions)}
+	for _, data := range []string{"foo", "bar"} {
+		stream.coalescer.Add([]byte(data), time.Now())
+		te.flushCommandOutput(conduit, testExecuteIntent, stream)
+	}
+	messages := te.messages(t)
+	assert.Len(t, messages, 2)
+	for i, m := range messages {
+		assert.Equal(t, "cell", m.ChannelId)
+		assert.Equal(t, string(channels.ContainerCommandStdoutEventName), m.EventName)
+		var entry commands.CommandOutputEntry
+		assert.Nil(t, json.Unmarshal(m.Payload, &entry))
+		assert.Equal(t, uint64(i+1), entry.Seq)
+	}
+	entries, _ := conduit.History.Since(0)
+	assert.Equal(t, []byte("bar"), entries[1].Data)
+}
+
+// Return the replay responses written to the connection
+func replayResponses(t *testing.T, messages []connection.DecodedMxWebsocketResponse) []commands.ContainerCommandReplayResponse {
+	responses := []commands.ContainerCommandReplayResponse{}
+	for _, m := range messages {
+		if m.EventName == string(channels.ContainerCommandReplayEventName) {
+			var r commands.ContainerCommandReplayResponse
+			assert.Nil(t, json.Unmarshal(m.Payload, &r))
+			responses = append(responses, r)
+		}
+	}
+	return responses
+}
+
+func TestReplayFinishedCommandOutput(t *testing.T) {
+	te := newTestExecutor(&fakeContainerService{})
+	history := channels.NewOutputHistory(4)
+	history.Append(string(channels.ContainerCommandStdoutEventName), []byte("foo"))
+	history.Append(string(channels.ContainerCommandStdoutEventName), []byte("bar"))
+	te.finished.Add("exec", "cell", history, time.Now())
+	// The command has finished and its channel is gone, its output is still retained
+	te.replayCommandOutputSaga(commands.ContainerCommandReplayIntent{ContainerId: "container", CellId: "cell", ExecId: "exec", Since: 1})
+	te.replayCommandOutputSaga(commands.ContainerCommandReplayIntent{ContainerId: "container", CellId: "cell", ExecId: "other", Since: 0})
+	responses := replayResponses(t, te.messages(t))
+	assert.Len(t, responses, 2)
+	assert.Equal(t, "", responses[0].Error)
+	assert.Equal(t, []commands.CommandOutputEntry{{Seq: 2, EventName: string(channels.ContainerCommandStdoutEventName), Data: []byte("bar")}}, responses[0].Entries)
+	assert.Equal(t, "output is no longer available", responses[1].Error)
+}
+
+func TestRecordedCellOutputs(t *testing.T) {
+	stdout, stderr := string(channels.ContainerCommandStdoutEventName), string(channels.ContainerCommandStderrEventName)
+	type batch struct {
+		eventName string
+		data      string
+	}
+	cases := []struct {
+		name        string
+		historySize int
+		batches     []batch
+		maxBytes    int
+		outputs     []notebooks.CellStreamOutput
+		truncated   bool
+	}{
+		{name: "no output", historySize: 4, maxBytes: 10, outputs: []notebooks.CellStreamOutput{}},
+		{name: "budget 0", historySize: 4, batches: []batch{{stdout, "foo"}}, maxBytes: 0, outputs: []notebooks.CellStreamOutput{}, truncated: true},
+		{name: "oversized batch", historySize: 4, batches: []batch{{stdout, "abcdef"}}, maxBytes: 4, outputs: []notebooks.CellStreamOutput{{Name: "stdout", Text: "cdef"}}, truncated: true},
+		{name: "oldest output dropped", historySize: 4, batches: []batch{{stdout, "foo"}, {stderr, "bar"}, {stdout, "baz"}}, maxBytes: 7, outputs: []notebooks.CellStreamOutput{{Name: "stdout", Text: "o"}, {Name: "stderr", Text: "bar"}, {Name: "stdout", Text: "baz"}}, truncated: true},
+		{name: "adjacent streams merged", historySize: 4, batches: []batch{{stdout, "foo"}, {stdout, "bar"}, {stderr, "err"}, {stderr, "!"}}, maxBytes: 100, outputs: []notebooks.CellStreamOutput{{Name: "stdout", Text: "foobar"}, {Name: "stderr", Text: "err!"}}},
+		{name: "evicted from history", historySize: 2, batches: []batch{{stdout, "foo"}, {stdout, "bar"}, {stdout, "baz"}}, maxBytes: 100, outputs: []notebooks.CellStreamOutput{{Name: "stdout", Text: "barbaz"}}, truncated: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			history := channels.NewOutputHistory(c.historySize)
+			for _, b := range c.batches {
+				history.Append(b.eventName, []byte(b.data))
+			}
+			outputs, truncated := recordedCellOutputs(history, c.maxBytes)
+			assert.Equal(t, c.outputs, outputs)
+			assert.Equal(t, c.truncated, truncated)
+		})
+	}
+}
+
+// Return the exec id of the command registered for a cell, or an empty id if there is none
+func (te *testExecutor) cellExecId(cellId string) string {
+	ch, err := te.session.GetChannelById(cellId)
+	if err != nil {
+		return ""
+	}
+	return ch.(*channels.ContainerCommandChannel).GetExecId()
+}
+
+func TestExecuteContainerCommandRerun(t *testing.T) {
+	first, second := newFakeCommand("exec-1"), newFakeCommand("exec-2")
+	cs := &fakeContainerService{commands: []*fakeCommand{first, second}, inspects: []inspectResult{{exitCode: 0}}}
+	te := newTestExecutor(cs)
+	te.executeContainerCommandSaga(testExecuteIntent)
+	assert.Equal(t, "exec-1", te.cellExecId("cell"))
+
+	// Running the cell again hands it to the new exec and kills the previous one
+	te.executeContainerCommandSaga(testExecuteIntent)
+	assert.Equal(t, "exec-2", te.cellExecId("cell"))
+	assert.Eventually(t, func() bool { return cs.isReleased("exec-1") }, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, []string{"KILL"}, cs.signals())
+	assert.True(t, conduitClosed(first.conduit))
+	// The listener of the replaced exec neither deregisters the new owner nor records the cell
+	assert.Equal(t, "exec-2", te.cellExecId("cell"))
+	assert.Empty(t, te.cells.outputs("cell"))
+
+	close(second.exit)
+	assert.Eventually(t, func() bool { return len(te.cells.outputs("cell")) == 1 }, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, "exec-2", te.cells.outputs("cell")[0].ExecId)
+	assert.Equal(t, "", te.cellExecId("cell"))
+
+	statuses, _ := commandEvents(t, te.messages(t))
+	successes := []commands.ContainerCommandStatusResponse{}
+	for _, status := range statuses {
+		if status.Status == "success" {
+			successes = append(successes, status)
+		}
+	}
+	assert.Len(t, successes, 2)
+	assert.Equal(t, "", successes[0].PreviousExecId)
+	assert.Equal(t, "exec-2", successes[1].ExecId)
+	assert.Equal(t, "exec-1", successes[1].PreviousExecId)
+}
+
+func TestExecuteContainerCommandRerunKeepPrevious(t *testing.T) {
+	first, second := newFakeCommand("exec-1"), newFakeCommand("exec-2")
+	cs := &fakeContainerService{commands: []*fakeCommand{first, second}, inspects: []inspectResult{{exitCode: 0}}}
+	te := newTestExecutor(cs)
+	te.executeContainerCommandSaga(testExecuteIntent)
+	keep := testExecuteIntent
+	keep.KeepPrevious = true
+	te.executeContainerCommandSaga(keep)
+	assert.Equal(t, "exec-2", te.cellExecId("cell"))
+
+	// The previous exec keeps running until it exits by itself
+	close(first.exit)
+	assert.Eventually(t, func() bool { return cs.isReleased("exec-1") }, time.Second*5, time.Millisecond*10)
+	assert.Empty(t, cs.signals())
+	assert.Equal(t, "exec-2", te.cellExecId("cell"))
+	assert.Empty(t, te.cells.outputs("cell"))
+	close(second.exit)
+	assert.Eventually(t, func() bool { return len(te.cells.outputs("cell")) == 1 }, time.Second*5, time.Millisecond*10)
+}
+
+func TestListenForCommandOutputTimeout(t *testing.T) {
+	command := newFakeCommand("exec")
+	cs := &fakeContainerService{}
+	te := newTestExecutor(cs)
+	intent := testExecuteIntent
+	intent.Timeout = 1
+	te.session.RegisterChannel("cell", channels.NewContainerCommandChannel("cell", "container", command.conduit))
+	// The command started a while ago, so its deadline has already passed
+	te.listenForComandOutput(command.conduit, intent, time.Now().Add(-time.Second))
+	assert.Eventually(t, func() bool { return len(te.cells.outputs("cell")) == 1 }, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, []string{"KILL"}, cs.signals())
+	assert.True(t, conduitClosed(command.conduit))
+	assert.True(t, cs.isReleased("exec"))
+	assert.Equal(t, "", te.cellExecId("cell"))
+	assert.Equal(t, "timed-out", te.cells.outputs("cell")[0].Status)
+	statuses, _ := commandEvents(t, te.messages(t))
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, "timed-out", statuses[0].Status)
+}
+
+func TestListenForCommandOutputCompleted(t *testing.T) {
+	command := newFakeCommand("exec")
+	cs := &fakeContainerService{inspects: []inspectResult{{exitCode: 2}}}
+	te := newTestExecutor(cs)
+	te.session.RegisterChannel("cell", channels.NewContainerCommandChannel("cell", "container", command.conduit))
+	te.listenForComandOutput(command.conduit, testExecuteIntent, time.Now())
+	command.conduit.ReadChan <- []byte("out")
+	command.conduit.ErrChan <- []byte("err")
+	close(command.exit)
+	assert.Eventually(t, func() bool { return len(te.cells.outputs("cell")) == 1 }, time.Second*5, time.Millisecond*10)
+	assert.True(t, conduitClosed(command.conduit))
+	assert.True(t, cs.isReleased("exec"))
+	assert.Equal(t, "", te.cellExecId("cell"))
+	assert.Empty(t, cs.signals())
+	recorded := te.cells.outputs("cell")[0]
+	assert.Equal(t, "completed", recorded.Status)
+	assert.Equal(t, 2, *recorded.ExitCode)
+	assert.ElementsMatch(t, []notebooks.CellStreamOutput{{Name: "stdout", Text: "out"}, {Name: "stderr", Text: "err"}}, recorded.Outputs)
+	statuses, codes := commandEvents(t, te.messages(t))
+	assert.Len(t, statuses, 1)
+	assert.Equal(t, "completed", statuses[0].Status)
+	assert.Equal(t, 2, *statuses[0].ExitCode)
+	assert.Empty(t, codes)
+}
+
+// Return the image pull progress and error codes written to the connection
+func pullEvents(t *testing.T, messages []connection.DecodedMxWebsocketResponse) ([]commands.ImagePullProgressResponse, []string) {
+	progress, codes := []commands.ImagePullProgressResponse{}, []string{}
+	for _, m := range messages {
+		switch m.EventName {
+		case string(channels.ImagePullProgressEventName):
+			var p commands.ImagePullProgressResponse
+			assert.Nil(t, json.Unmarshal(m.Payload, &p))
+			progress = append(progress, p)
+		case channels.ErrorEventName:
+			var e commands.ErrorResponse
+			assert.Nil(t, json.Unmarshal(m.Payload, &e))
+			codes = append(codes, e.Code)
+		}
+	}
+	return progress, codes
+}
+
+func TestPullImageSagaFails(t *testing.T) {
+	cs := &fakeContainerService{
+		pullProgress: []commands.ImagePullProgressResponse{{Image: "python:3.9", Hash: "h", LayerId: "a1b2", Status: "Downloading", Current: 512, Total: 2048}},
+		pullErr:      errors.New("unauthorized: access denied"),
+	}
+	te := newTestExecutor(cs)
+	err := te.pullImageSaga(commands.ImagePullCommandIntent{RequestEnvelope: commands.RequestEnvelope{RequestId: "req"}, ChannelId: "root", Image: "python", Tag: "3.9", Hash: "h"})
+	assert.EqualError(t, err, "unauthorized: access denied")
+	messages := te.messages(t)
+	for _, m := range messages {
+		assert.Equal(t, "root", m.ChannelId)
+	}
+	progress, codes := pullEvents(t, messages)
+	assert.Equal(t, []commands.ImagePullProgressResponse{
+		{Image: "python:3.9", Hash: "h", LayerId: "a1b2", Status: "Downloading", Current: 512, Total: 2048},
+		{Image: "python", Hash: "h", Status: "failed", Error: "unauthorized: access denied", RequestId: "req"},
+	}, progress)
+	assert.Equal(t, []string{"image-pull-failed"}, codes)
+}
+
+func TestPullImageSaga(t *testing.T) {
+	cs := &fakeContainerService{pullProgress: []commands.ImagePullProgressResponse{{Image: "python:3.9", Hash: "h", Status: "Pull complete"}}}
+	te := newTestExecutor(cs)
+	err := te.pullImageSaga(commands.ImagePullCommandIntent{ChannelId: "root", Image: "python", Tag: "3.9", Hash: "h"})
+	assert.Nil(t, err)
+	progress, codes := pullEvents(t, te.messages(t))
+	assert.Equal(t, []commands.ImagePullProgressResponse{{Image: "python:3.9", Hash: "h", Status: "Pull complete"}}, progress)
+	assert.Empty(t, codes)
+}
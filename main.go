@@ -4,17 +4,26 @@ import (
 	"flag"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/docker/docker/client"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/unklearn/notebook-backend/channels"
 	"github.com/unklearn/notebook-backend/connection"
 	containerservices "github.com/unklearn/notebook-backend/container-services"
 	"github.com/unklearn/notebook-backend/notebooks"
+	"github.com/unklearn/notebook-backend/sessions"
 )
 
 var addr = flag.String("addr", "localhost:8080", "http service address")
+var registryConfig = flag.String("registry-config", "", "path to registry credentials file")
+var maxOutputRate = flag.Int("max-output-rate", channels.DefaultOutputOptions.MaxThroughput, "max bytes per second of output relayed per command, 0 for no limit")
+var maxRecordedOutput = flag.Int("max-recorded-output", DefaultCommandExecutorOptions.MaxRecordedOutput, "max bytes of output recorded into the notebook per cell")
+var outputRetention = flag.Duration("output-retention", DefaultCommandExecutorOptions.OutputRetention, "how long the output of a finished command can be replayed")
+var maxFrameSize = flag.Int("max-frame-size", connection.DefaultMaxFrameSize, "max size in bytes of a message received from the notebook, 0 for no limit")
+var sessionIdleTimeout = flag.Duration("session-idle-timeout", 10*time.Minute, "how long a notebook session is kept without a connection before its containers are stopped")
 
 func CheckOrigin(r *http.Request) bool {
 	return true
@@ -22,41 +31,74 @@ func CheckOrigin(r *http.Request) bool {
 
 var dcs *containerservices.DockerContainerService
 
+var sessionManager *sessions.Manager
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: CheckOrigin,
-} // use default options
+	// Versions of the framing, the newest version the notebook supports is picked
+	Subprotocols: connection.Subprotocols,
+}
 
 func HandleWS(w http.ResponseWriter, r *http.Request) {
 	c, err := upgrader.Upgrade(w, r, nil)
-	// Use the path for registering channels to conn
-	vars := mux.Vars(r)
-	notebookId := vars["notebookId"]
-
-	// Maps execId to a multiplexed connection
-	mx := connection.NewMxedWebsocketConn(c, notebookId)
-	mx.RegisterChannel(notebookId, channels.NewRootChannel(notebookId))
-
 	if err != nil {
 		log.Print("upgrade error:", err)
 		return
 	}
-	defer c.Close()
-	executor := NewCommandExecutor(dcs, mx)
+	// Use the path for registering channels to conn
+	vars := mux.Vars(r)
+	notebookId := vars["notebookId"]
+
+	// Frame messages with the negotiated subprotocol, all offered subprotocols are known
+	options := connection.DefaultMxedWebsocketConnOptions
+	// Output is fanned out to every viewer of the notebook, a viewer that falls behind is
+	// disconnected rather than holding up the others. It replays what it missed on reconnect
+	options.Policy = connection.DisconnectSlowConsumer
+	options.Protocol, _ = connection.GetSubprotocol(c.Subprotocol(), *maxFrameSize)
+	// Oversized messages are refused by the websocket before they are buffered
+	c.SetReadLimit(int64(*maxFrameSize))
+	// Connections are identified separately, a notebook can have several viewers
+	mx := connection.NewMxedWebsocketConnWithOptions(c, uuid.NewString(), options)
+	defer mx.Close()
+	// Attach to the session of the notebook, which keeps running after the connection closes
+	session := sessionManager.Attach(notebookId, mx)
+	defer sessionManager.Detach(session, mx)
 	// Run connector handler
-	executor.ConnectionHandler()
+	session.ConnectionHandler(mx)
+}
+
+// Create the executor of a new notebook session
+func newSessionExecutor(s *sessions.Session) sessions.ISessionExecutor {
+	options := DefaultCommandExecutorOptions
+	options.Output.MaxThroughput = *maxOutputRate
+	options.MaxRecordedOutput = *maxRecordedOutput
+	options.OutputRetention = *outputRetention
+	return NewCommandExecutor(dcs, notebooks.GetNotebookService(), s, options)
 }
 
 // Main serve function that runs the HTTP handler routes as well as the websocker handler.
 // The routes will handle notebook related API calls, and the websocket will relay container
 // outputs and execution status of a cell.
 func main() {
+	flag.Parse()
 	// Create new docker client
 	cli, err := client.NewClientWithOpts()
 	router := mux.NewRouter()
 	if err != nil {
 		panic(err)
 	}
-	dcs = containerservices.NewDockerContainerService(cli)
+	// Load registry credentials for private images
+	var credentials *containerservices.RegistryCredentialStore
+	if *registryConfig != "" {
+		credentials, err = containerservices.LoadRegistryCredentialStore(*registryConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	dcs = containerservices.NewDockerContainerService(cli, credentials)
+	// Sessions are checked for idleness a few times per idle timeout
+	sessionManager = sessions.NewManager(newSessionExecutor, *sessionIdleTimeout)
+	go sessionManager.Run(*sessionIdleTimeout/4, nil)
 
 	// Register websocket handler
 	router.HandleFunc("/websocket/{notebookId}", HandleWS)
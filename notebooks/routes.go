@@ -9,6 +9,11 @@ import (
 
 var nbService = NewNotebookCRUDService("/tmp/notebooks")
 
+// Return the service that backs the notebook routes
+func GetNotebookService() *NotebookCRUDService {
+	return nbService
+}
+
 func respondWithError(w http.ResponseWriter, code int, message string) {
 	respondWithJSON(w, code, map[string]string{"error": message})
 }
@@ -2,9 +2,12 @@ package notebooks
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/spf13/afero"
@@ -13,6 +16,28 @@ import (
 type NotebookCRUDService struct {
 	fs      afero.Fs
 	rootDir string
+	// Serializes read-modify-write cycles on notebook files
+	mu sync.Mutex
+}
+
+// A stream of output produced by a cell, modelled after ipynb stream outputs
+type CellStreamOutput struct {
+	// One of stdout, stderr or output for commands that run with a TTY
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// The recorded result of the last execution of a cell
+type CellOutput struct {
+	ExecId string `json:"exec_id"`
+	// Final status of the command, e.g. completed or timed-out
+	Status     string             `json:"status"`
+	ExitCode   *int               `json:"exit_code,omitempty"`
+	StartedAt  time.Time          `json:"started_at"`
+	FinishedAt time.Time          `json:"finished_at"`
+	Outputs    []CellStreamOutput `json:"outputs"`
+	// Set if the output was cut down before it was recorded
+	Truncated bool `json:"truncated"`
 }
 
 func NewNotebookCRUDService(dbDir string) *NotebookCRUDService {
@@ -39,23 +64,50 @@ func (nb *NotebookCRUDService) Create(payload map[string]interface{}) (map[strin
 	return payload, err
 }
 
-// Update a notebook by saving its new contents
+// Update a notebook by saving its new contents. Executions recorded by the backend are
+// kept for cells that the payload sends without one
 func (nb *NotebookCRUDService) Update(notebookId string, payload map[string]interface{}) (map[string]interface{}, error) {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
 	notebookFilePath := filepath.Join(nb.rootDir, sanitizeNotebookId(notebookId))
-	_, err := nb.fs.Stat(notebookFilePath)
+	stored, err := afero.ReadFile(nb.fs, notebookFilePath)
+	if err != nil {
+		return nil, err
+	}
+	var notebook map[string]interface{}
+	if err := json.Unmarshal(stored, &notebook); err == nil {
+		keepCellExecutions(notebook, payload)
+	}
+	contents, _ := json.Marshal(payload)
+	err = afero.WriteFile(nb.fs, notebookFilePath, contents, os.ModePerm)
 	if err != nil {
 		return nil, err
-	} else {
-		file, err := nb.fs.OpenFile(notebookFilePath, os.O_WRONLY, os.ModePerm)
-		if err != nil {
-			return nil, err
+	}
+	return payload, nil
+}
+
+// Copy the recorded execution of stored cells onto the cells of the payload that do not
+// carry one, matching cells by id
+func keepCellExecutions(stored map[string]interface{}, payload map[string]interface{}) {
+	executions := map[interface{}]interface{}{}
+	storedCells, _ := stored["cells"].([]interface{})
+	for _, c := range storedCells {
+		if cell, ok := c.(map[string]interface{}); ok && cell["execution"] != nil {
+			executions[cell["id"]] = cell["execution"]
 		}
-		contents, _ := json.Marshal(payload)
-		_, err = file.Write(contents)
-		if err != nil {
-			return nil, err
+	}
+	cells, _ := payload["cells"].([]interface{})
+	for _, c := range cells {
+		cell, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, sent := cell["execution"]; sent {
+			continue
+		}
+		if execution, ok := executions[cell["id"]]; ok {
+			cell["execution"] = execution
 		}
-		return payload, nil
 	}
 }
 
@@ -69,3 +121,30 @@ func (nb *NotebookCRUDService) GetById(docId string) (map[string]interface{}, er
 	}
 	return s, nil
 }
+
+// Record the output of a cell execution into the cell entry of the notebook, replacing
+// the output of any previous execution
+func (nb *NotebookCRUDService) RecordCellOutput(notebookId string, cellId string, output CellOutput) error {
+	nb.mu.Lock()
+	defer nb.mu.Unlock()
+	notebookFilePath := filepath.Join(nb.rootDir, sanitizeNotebookId(notebookId))
+	contents, err := afero.ReadFile(nb.fs, notebookFilePath)
+	if err != nil {
+		return err
+	}
+	var notebook map[string]interface{}
+	if err := json.Unmarshal(contents, &notebook); err != nil {
+		return err
+	}
+	cells, _ := notebook["cells"].([]interface{})
+	for _, c := range cells {
+		cell, ok := c.(map[string]interface{})
+		if !ok || cell["id"] != cellId {
+			continue
+		}
+		cell["execution"] = output
+		contents, _ := json.Marshal(notebook)
+		return afero.WriteFile(nb.fs, notebookFilePath, contents, os.ModePerm)
+	}
+	return fmt.Errorf("cell %s does not exist in notebook %s", cellId, notebookId)
+}
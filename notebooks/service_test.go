@@ -0,0 +1,71 @@
+package notebooks
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordCellOutput(t *testing.T) {
+	nb := &NotebookCRUDService{fs: afero.NewMemMapFs(), rootDir: "/notebooks"}
+	afero.WriteFile(nb.fs, "/notebooks/nb-1", []byte(`{"id": "nb-1", "containers": [], "cells": [{"id": "cell-1", "source": "ls"}]}`), 0644)
+	exitCode := 0
+	output := CellOutput{
+		ExecId:     "exec",
+		Status:     "completed",
+		ExitCode:   &exitCode,
+		StartedAt:  time.Unix(100, 0).UTC(),
+		FinishedAt: time.Unix(101, 0).UTC(),
+		Outputs:    []CellStreamOutput{{Name: "stdout", Text: "app.py\n"}},
+	}
+	err := nb.RecordCellOutput("nb-1", "cell-1", output)
+	assert.Equal(t, err, nil)
+
+	contents, _ := afero.ReadFile(nb.fs, "/notebooks/nb-1")
+	var notebook struct {
+		Cells []struct {
+			Id        string     `json:"id"`
+			Source    string     `json:"source"`
+			Execution CellOutput `json:"execution"`
+		} `json:"cells"`
+	}
+	json.Unmarshal(contents, &notebook)
+	assert.Equal(t, notebook.Cells[0].Source, "ls")
+	assert.Equal(t, notebook.Cells[0].Execution, output)
+
+	// Unknown cells and notebooks are rejected
+	assert.NotEqual(t, nb.RecordCellOutput("nb-1", "cell-2", output), nil)
+	assert.NotEqual(t, nb.RecordCellOutput("nb-2", "cell-1", output), nil)
+}
+
+func TestUpdateKeepsCellExecutions(t *testing.T) {
+	nb := &NotebookCRUDService{fs: afero.NewMemMapFs(), rootDir: "/notebooks"}
+	afero.WriteFile(nb.fs, "/notebooks/nb-1", []byte(`{"id": "nb-1", "cells": [{"id": "cell-1", "source": "ls", "execution": {"exec_id": "exec-1"}}, {"id": "cell-2", "source": "pwd", "execution": {"exec_id": "exec-2"}}]}`), 0644)
+	var payload map[string]interface{}
+	// The first cell is edited, the second one is sent with an execution of its own, and a new cell is added
+	json.Unmarshal([]byte(`{"id": "nb-1", "cells": [{"id": "cell-1", "source": "ls -l"}, {"id": "cell-2", "source": "pwd", "execution": null}, {"id": "cell-3", "source": "id"}]}`), &payload)
+	_, err := nb.Update("nb-1", payload)
+	assert.Equal(t, err, nil)
+
+	contents, _ := afero.ReadFile(nb.fs, "/notebooks/nb-1")
+	var notebook struct {
+		Cells []struct {
+			Id        string      `json:"id"`
+			Source    string      `json:"source"`
+			Execution *CellOutput `json:"execution"`
+		} `json:"cells"`
+	}
+	assert.Equal(t, json.Unmarshal(contents, &notebook), nil)
+	assert.Equal(t, len(notebook.Cells), 3)
+	assert.Equal(t, notebook.Cells[0].Source, "ls -l")
+	assert.Equal(t, notebook.Cells[0].Execution.ExecId, "exec-1")
+	assert.Equal(t, notebook.Cells[1].Execution, (*CellOutput)(nil))
+	assert.Equal(t, notebook.Cells[2].Execution, (*CellOutput)(nil))
+
+	// Missing notebooks are not created
+	_, err = nb.Update("nb-2", payload)
+	assert.NotEqual(t, err, nil)
+}
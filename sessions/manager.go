@@ -0,0 +1,92 @@
+package sessions
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/unklearn/notebook-backend/connection"
+)
+
+// Manager keeps a session per notebook, so that a notebook can reconnect to its running
+// containers and commands. Sessions without a connection are collected after an idle timeout
+type Manager struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	// Creates the executor of a new session
+	newExecutor func(s *Session) ISessionExecutor
+	idleTimeout time.Duration
+}
+
+func NewManager(newExecutor func(s *Session) ISessionExecutor, idleTimeout time.Duration) *Manager {
+	return &Manager{
+		sessions:    make(map[string]*Session),
+		newExecutor: newExecutor,
+		idleTimeout: idleTimeout,
+	}
+}
+
+// Attach a connection to the session of a notebook, creating the session if there is none.
+// Any number of connections can view the same session
+func (m *Manager) Attach(notebookId string, conn *connection.MxedWebsocketConn) *Session {
+	m.mu.Lock()
+	s, ok := m.sessions[notebookId]
+	if !ok {
+		log.Printf("Creating session for notebook %s\n", notebookId)
+		s = NewSession(notebookId)
+		s.executor = m.newExecutor(s)
+		m.sessions[notebookId] = s
+	}
+	// Attach under the lock, so that the session cannot be collected in between
+	s.attach(conn)
+	m.mu.Unlock()
+	return s
+}
+
+// Detach a connection from its session. The session is kept until it has been idle for
+// the idle timeout
+func (m *Manager) Detach(s *Session, conn *connection.MxedWebsocketConn) {
+	s.detach(conn, time.Now())
+}
+
+// Returns the session of a notebook
+func (m *Manager) GetSession(notebookId string) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[notebookId]
+	return s, ok
+}
+
+// Shut down and remove sessions that have been idle for the idle timeout. Returns the
+// number of sessions collected
+func (m *Manager) CollectIdle(now time.Time) int {
+	m.mu.Lock()
+	idle := []*Session{}
+	for id, s := range m.sessions {
+		if s.idle(now, m.idleTimeout) {
+			idle = append(idle, s)
+			delete(m.sessions, id)
+		}
+	}
+	m.mu.Unlock()
+	// Shutting down stops containers, which can take a while
+	for _, s := range idle {
+		log.Printf("Collecting idle session for notebook %s\n", s.Id)
+		s.executor.Shutdown()
+	}
+	return len(idle)
+}
+
+// Collect idle sessions every interval until stop is closed
+func (m *Manager) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.CollectIdle(now)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package sessions
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/unklearn/notebook-backend/channels"
+	"github.com/unklearn/notebook-backend/commands"
+	"github.com/unklearn/notebook-backend/connection"
+)
+
+type fakeExecutor struct {
+	mu         sync.Mutex
+	dispatched []commands.ActionIntent
+	shutdown   int
+}
+
+func (f *fakeExecutor) DispatchIntents(intents []commands.ActionIntent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dispatched = append(f.dispatched, intents...)
+}
+
+func (f *fakeExecutor) Shutdown() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.shutdown += 1
+}
+
+type fakeWebsocketConn struct {
+	mu      sync.Mutex
+	written [][]byte
+	closed  bool
+	// Messages returned by ReadMessage, reads fail once it is drained
+	reads [][]byte
+}
+
+func (f *fakeWebsocketConn) WriteMessage(messageType int, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = append(f.written, payload)
+	return nil
+}
+
+func (f *fakeWebsocketConn) ReadMessage() (messageType int, payload []byte, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.reads) == 0 {
+		return 0, nil, io.EOF
+	}
+	payload, f.reads = f.reads[0], f.reads[1:]
+	return 2, payload, nil
+}
+
+func (f *fakeWebsocketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (f *fakeWebsocketConn) messages() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte{}, f.written...)
+}
+
+func (f *fakeWebsocketConn) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+func newTestManager(timeout time.Duration) (*Manager, map[string]*fakeExecutor) {
+	executors := map[string]*fakeExecutor{}
+	m := NewManager(func(s *Session) ISessionExecutor {
+		e := &fakeExecutor{}
+		executors[s.Id] = e
+		return e
+	}, timeout)
+	return m, executors
+}
+
+func TestManagerAttachCreatesSession(t *testing.T) {
+	m, executors := newTestManager(time.Minute)
+	mx := connection.NewMxedWebsocketConn(&fakeWebsocketConn{}, "nb")
+	s := m.Attach("nb", mx)
+	assert.Equal(t, "nb", s.Id)
+	assert.Contains(t, executors, "nb")
+	// The root channel of the notebook is registered with the session
+	ch, err := s.GetChannelById("nb")
+	assert.Nil(t, err)
+	assert.IsType(t, &channels.RootChannel{}, ch)
+	got, ok := m.GetSession("nb")
+	assert.True(t, ok)
+	assert.Same(t, s, got)
+}
+
+func TestManagerReattachKeepsSession(t *testing.T) {
+	m, executors := newTestManager(time.Minute)
+	first := connection.NewMxedWebsocketConn(&fakeWebsocketConn{}, "nb")
+	s := m.Attach("nb", first)
+	s.RegisterChannel("container", channels.NewContainerChannel("container"))
+	m.Detach(s, first)
+
+	second := connection.NewMxedWebsocketConn(&fakeWebsocketConn{}, "nb")
+	assert.Same(t, s, m.Attach("nb", second))
+	assert.Len(t, executors, 1)
+	// Channels registered over the first connection are still available
+	_, err := s.GetChannelById("container")
+	assert.Nil(t, err)
+}
+
+func TestSessionWriteMessageFansOut(t *testing.T) {
+	m, _ := newTestManager(time.Minute)
+	firstWs, secondWs := &fakeWebsocketConn{}, &fakeWebsocketConn{}
+	first := connection.NewMxedWebsocketConn(firstWs, "a")
+	second := connection.NewMxedWebsocketConn(secondWs, "b")
+	s := m.Attach("nb", first)
+	assert.Same(t, s, m.Attach("nb", second))
+	assert.Nil(t, s.WriteMessage("nb", "e", []byte("m")))
+	// A closed viewer does not keep the message from the others
+	first.Close()
+	assert.Equal(t, connection.ErrConnectionClosed, s.WriteMessage("nb", "e", []byte("m")))
+	second.Close()
+	assert.Len(t, firstWs.messages(), 1)
+	assert.Len(t, secondWs.messages(), 2)
+}
+
+// A websocket conn that never completes a write, like a client that stopped reading
+type stalledWebsocketConn struct {
+	fakeWebsocketConn
+	release chan struct{}
+}
+
+func (s *stalledWebsocketConn) WriteMessage(messageType int, payload []byte) error {
+	<-s.release
+	return nil
+}
+
+func TestSessionWriteMessageSlowViewer(t *testing.T) {
+	m, _ := newTestManager(time.Minute)
+	stalledWs := &stalledWebsocketConn{release: make(chan struct{})}
+	defer close(stalledWs.release)
+	options := connection.MxedWebsocketConnOptions{QueueSize: 1, Policy: connection.DisconnectSlowConsumer}
+	stalled := connection.NewMxedWebsocketConnWithOptions(stalledWs, "stalled", options)
+	ws := &fakeWebsocketConn{}
+	viewer := connection.NewMxedWebsocketConn(ws, "viewer")
+	s := m.Attach("nb", stalled)
+	m.Attach("nb", viewer)
+	// A viewer that stopped reading is disconnected, and does not hold up the others
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			s.WriteMessage("nb", "e", []byte("m"))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("a stalled viewer blocked the session")
+	}
+	viewer.Close()
+	assert.Len(t, ws.messages(), 5)
+	assert.Equal(t, connection.ErrSlowConsumer, stalled.WriteMessage("nb", "e", []byte("m")))
+}
+
+func TestConnectionHandlerStdinOwner(t *testing.T) {
+	m, _ := newTestManager(time.Minute)
+	protocol := connection.NewMxedWebsocketSubprotocol()
+	input := protocol.Encode("cell", string(channels.ContainerCommandInputEventname), []byte("ls\n"))
+	conduit := channels.NewBidirectionalContainerConduit("exec", nil)
+	go func() {
+		for range conduit.WriteChan {
+		}
+	}()
+	ownerWs, viewerWs := &fakeWebsocketConn{reads: [][]byte{input}}, &fakeWebsocketConn{reads: [][]byte{input}}
+	owner := connection.NewMxedWebsocketConn(ownerWs, "owner")
+	viewer := connection.NewMxedWebsocketConn(viewerWs, "viewer")
+	s := m.Attach("nb", owner)
+	m.Attach("nb", viewer)
+	s.RegisterChannel("cell", channels.NewContainerCommandChannel("cell", "container", conduit))
+
+	// The first connection to write claims stdin, other viewers are rejected
+	s.ConnectionHandler(owner)
+	s.ConnectionHandler(viewer)
+	viewer.Close()
+	assert.Len(t, viewerWs.messages(), 1)
+	assertErrorEvent(t, viewerWs.messages()[0], "cell", ErrStdinOwned.Code)
+
+	// Stdin is released once the owner leaves
+	m.Detach(s, owner)
+	cch, _ := s.GetChannelById("cell")
+	assert.True(t, cch.(*channels.ContainerCommandChannel).ClaimStdin("viewer"))
+}
+
+// Assert that a written message is an error event with the given code
+func assertErrorEvent(t *testing.T, message []byte, channelId string, code string) commands.ErrorResponse {
+	decoded, err := connection.NewMxedWebsocketSubprotocol().Decode(message)
+	assert.Nil(t, err)
+	assert.Equal(t, channelId, decoded.ChannelId)
+	assert.Equal(t, channels.ErrorEventName, decoded.EventName)
+	var e commands.ErrorResponse
+	assert.Nil(t, json.Unmarshal(decoded.Payload, &e))
+	assert.Equal(t, code, e.Code)
+	assert.Equal(t, channelId, e.ChannelId)
+	return e
+}
+
+func TestConnectionHandlerErrors(t *testing.T) {
+	m, executors := newTestManager(time.Minute)
+	protocol := connection.NewMxedWebsocketSubprotocol()
+	ws := &fakeWebsocketConn{reads: [][]byte{
+		// Frames that cannot be decoded do not close the connection
+		protocol.Encode("", "event", nil),
+		protocol.Encode("missing", "event", nil),
+		protocol.Encode("container", string(channels.ContainerExecuteCommandEventName), []byte(`{"request_id": "req-1", "cell_id": "cell"}`)),
+	}}
+	mx := connection.NewMxedWebsocketConn(ws, "conn")
+	s := m.Attach("nb", mx)
+	s.RegisterChannel("container", channels.NewContainerChannel("container"))
+	s.ConnectionHandler(mx)
+	mx.Close()
+	messages := ws.messages()
+	assert.Len(t, messages, 3)
+	assertErrorEvent(t, messages[0], "nb", connection.ErrBadChannelId.Code)
+	assertErrorEvent(t, messages[1], "missing", "missing-channel")
+	e := assertErrorEvent(t, messages[2], "container", "invalid-request")
+	// Errors echo the request id of the payload that caused them
+	assert.Equal(t, "req-1", e.RequestId)
+	assert.Len(t, executors["nb"].dispatched, 0)
+}
+
+func TestConnectionHandlerStampsConnectionId(t *testing.T) {
+	m, executors := newTestManager(time.Minute)
+	protocol := connection.NewMxedWebsocketSubprotocol()
+	execute := protocol.Encode("container", string(channels.ContainerExecuteCommandEventName), []byte(`{"cell_id": "cell", "command": ["ls"]}`))
+	mx := connection.NewMxedWebsocketConn(&fakeWebsocketConn{reads: [][]byte{execute}}, "conn")
+	s := m.Attach("nb", mx)
+	s.RegisterChannel("container", channels.NewContainerChannel("container"))
+	s.ConnectionHandler(mx)
+	assert.Len(t, executors["nb"].dispatched, 1)
+	intent := executors["nb"].dispatched[0].(commands.ContainerExecuteCommandIntent)
+	assert.Equal(t, "conn", intent.ConnectionId)
+}
+
+func TestSessionWriteMessage(t *testing.T) {
+	m, _ := newTestManager(time.Minute)
+	ws := &fakeWebsocketConn{}
+	mx := connection.NewMxedWebsocketConn(ws, "nb")
+	s := m.Attach("nb", mx)
+	assert.Nil(t, s.WriteMessage("nb", "e", []byte("m")))
+	mx.Close()
+	assert.Len(t, ws.written, 1)
+
+	m.Detach(s, mx)
+	assert.Equal(t, ErrNoConnection, s.WriteMessage("nb", "e", []byte("m")))
+}
+
+func TestSessionDispatchIntents(t *testing.T) {
+	m, executors := newTestManager(time.Minute)
+	s := m.Attach("nb", connection.NewMxedWebsocketConn(&fakeWebsocketConn{}, "nb"))
+	intent := commands.ContainerStopCommandIntent{ContainerId: "container"}
+	s.DispatchIntents([]commands.ActionIntent{intent})
+	assert.Equal(t, []commands.ActionIntent{intent}, executors["nb"].dispatched)
+}
+
+func TestManagerCollectIdle(t *testing.T) {
+	m, executors := newTestManager(time.Minute)
+	mx := connection.NewMxedWebsocketConn(&fakeWebsocketConn{}, "nb")
+	s := m.Attach("nb", mx)
+	// Sessions with a connection are never idle
+	assert.Equal(t, 0, m.CollectIdle(time.Now().Add(time.Hour)))
+
+	m.Detach(s, mx)
+	assert.Equal(t, 0, m.CollectIdle(time.Now().Add(time.Second)))
+	assert.Equal(t, 0, executors["nb"].shutdown)
+
+	assert.Equal(t, 1, m.CollectIdle(time.Now().Add(time.Minute)))
+	assert.Equal(t, 1, executors["nb"].shutdown)
+	_, ok := m.GetSession("nb")
+	assert.False(t, ok)
+	// A new connection gets a fresh session
+	assert.NotSame(t, s, m.Attach("nb", connection.NewMxedWebsocketConn(&fakeWebsocketConn{}, "nb")))
+}
@@ -0,0 +1,168 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/unklearn/notebook-backend/channels"
+	"github.com/unklearn/notebook-backend/commands"
+	"github.com/unklearn/notebook-backend/connection"
+)
+
+var (
+	ErrNoConnection = commands.NewErrorResponse("no-connection", "No connection is attached to the session")
+	ErrStdinOwned   = commands.NewErrorResponse("stdin-owned", "Stdin of the command is owned by another connection")
+)
+
+// Runs the intents of a session. The executor lives as long as the session, so that
+// running commands are not lost when the connection drops
+type ISessionExecutor interface {
+	DispatchIntents(intents []commands.ActionIntent)
+	// Release the containers and commands of the session once it is collected
+	Shutdown()
+}
+
+// A session holds the channels and the executor of a notebook. Connections attach to
+// the session and detach from it, while containers and commands keep running. Every
+// attached connection views the notebook, and receives status and output of its containers
+type Session struct {
+	Id string
+	*channels.Registry
+	executor ISessionExecutor
+	mu       sync.Mutex
+	// The attached connections, empty while the notebook is disconnected
+	conns []*connection.MxedWebsocketConn
+	// Time at which the last connection detached
+	detachedAt time.Time
+}
+
+func NewSession(id string) *Session {
+	s := &Session{
+		Id:         id,
+		Registry:   &channels.Registry{},
+		detachedAt: time.Now(),
+	}
+	s.RegisterChannel(id, channels.NewRootChannel(id))
+	return s
+}
+
+// Write a message to every attached connection. Messages written while no connection is
+// attached are dropped, command output can still be replayed from the output history.
+// Returns the first error, a connection that fails does not keep others from the message.
+// Connections are written in turn, so they should drop or disconnect slow consumers
+// rather than block
+func (s *Session) WriteMessage(channelId string, eventName string, message []byte) error {
+	conns := s.connections()
+	if len(conns) == 0 {
+		return ErrNoConnection
+	}
+	var err error
+	for _, conn := range conns {
+		if e := conn.WriteMessage(channelId, eventName, message); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Return a snapshot of the attached connections
+func (s *Session) connections() []*connection.MxedWebsocketConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*connection.MxedWebsocketConn{}, s.conns...)
+}
+
+// Dispatch intents to the executor of the session
+func (s *Session) DispatchIntents(intents []commands.ActionIntent) {
+	s.executor.DispatchIntents(intents)
+}
+
+// Read messages from a connection attached to the session and dispatch the resulting
+// intents, until the connection is closed
+func (s *Session) ConnectionHandler(mx *connection.MxedWebsocketConn) {
+	for {
+		d, err := mx.ReadMessage()
+		var decodeErr *commands.ErrorResponse
+		if errors.As(err, &decodeErr) {
+			// The message could not be decoded, its channel is not known
+			writeError(mx, decodeErr.For(s.Id, ""))
+			continue
+		}
+		if err != nil {
+			log.Println("Error while reading from connection:", err)
+			break
+		}
+		ch, e := s.GetChannelById(d.ChannelId)
+		if e != nil {
+			log.Printf("Error while retrieving channel %s", d.ChannelId)
+			writeError(mx, commands.ToErrorResponse(e, "missing-channel").For(d.ChannelId, commands.ParseRequestId(d.Payload)))
+			continue
+		}
+		// Only one connection can write to a command, others view its output. Input is
+		// raw bytes, so its errors have no request id
+		if cch, ok := ch.(*channels.ContainerCommandChannel); ok && d.EventName == string(channels.ContainerCommandInputEventname) && !cch.ClaimStdin(mx.Id) {
+			writeError(mx, ErrStdinOwned.For(d.ChannelId, ""))
+			continue
+		}
+		intents, e := ch.HandleMessage(d.EventName, d.Payload)
+		if e != nil {
+			// Intents that cannot be parsed are rejected with the validation error
+			writeError(mx, commands.ToErrorResponse(e, "invalid-request").For(d.ChannelId, commands.ParseRequestId(d.Payload)))
+		}
+		// Commands are owned by the connection that runs them
+		for i, intent := range intents {
+			if exec, ok := intent.(commands.ContainerExecuteCommandIntent); ok {
+				exec.ConnectionId = mx.Id
+				intents[i] = exec
+			}
+		}
+		// Dispatch intents
+		s.DispatchIntents(intents)
+	}
+}
+
+// Write an error onto the error event of a connection
+func writeError(mx *connection.MxedWebsocketConn, e *commands.ErrorResponse) {
+	out, _ := json.Marshal(e)
+	if we := mx.WriteMessage(e.ChannelId, channels.ErrorEventName, out); we != nil {
+		log.Println("Error while writing to connection:", we)
+	}
+}
+
+// Attach a connection to the session, alongside the connections already viewing it
+func (s *Session) attach(conn *connection.MxedWebsocketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns = append(s.conns, conn)
+}
+
+// Detach a connection from the session. Stdin of commands owned by the connection is
+// released, so that another viewer can write to them
+func (s *Session) detach(conn *connection.MxedWebsocketConn, now time.Time) {
+	s.mu.Lock()
+	for i, c := range s.conns {
+		if c == conn {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			break
+		}
+	}
+	if len(s.conns) == 0 {
+		s.detachedAt = now
+	}
+	s.mu.Unlock()
+	for _, ch := range s.ListChannels() {
+		if cch, ok := ch.(*channels.ContainerCommandChannel); ok {
+			cch.ReleaseStdin(conn.Id)
+		}
+	}
+}
+
+// Returns true if no connection has been attached to the session for the idle timeout
+func (s *Session) idle(now time.Time, timeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns) == 0 && now.Sub(s.detachedAt) >= timeout
+}